@@ -0,0 +1,286 @@
+package aead
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// an encryption layer that runs inside the tunnel, so confidentiality
+// doesn't depend on the outer TLS hop.
+//
+// Both peers start by sending a preface with an ephemeral X25519 public key,
+// the client sends its preface first and the server answers with its own:
+//
+// +-------+--------+------------+
+// | MAGIC | CIPHER | PUBLIC KEY |
+// +-------+--------+------------+
+// |   2   |   1    |     32     |
+// +-------+--------+------------+
+//
+// The keys of both directions are derived with HKDF-SHA256 from the shared
+// secret, salted with the pre-shared key and bound to both public keys. the
+// pre-shared key is what authenticates the exchange, a peer without it ends
+// up with other keys, so it's required. After the prefaces, every record is formed as follows:
+//
+// +--------+-----------------+
+// | LENGTH | CIPHERTEXT, TAG |
+// +--------+-----------------+
+// |   2    |     LENGTH      |
+// +--------+-----------------+
+//
+// LENGTH is big endian, nonces are 96 bit little endian counters starting at
+// zero for each direction.
+
+// supported ciphers
+const (
+	ChaCha20Poly1305 byte = 0x01
+	AES256GCM        byte = 0x02
+)
+
+// MaxPayloadSize is the largest plaintext a single record carries
+const MaxPayloadSize = 16 * 1024
+
+const (
+	prefaceSize = 3 + curve25519.PointSize
+	keySize     = 32
+	info        = "egg aead v1"
+)
+
+var prefaceMagic = []byte{0x45, 0x45}
+
+var (
+	ErrBadPreface        = errors.New("aead: bad preface")
+	ErrUnsupportedCipher = errors.New("aead: unsupported cipher")
+	ErrNoPSK             = errors.New("aead: a pre-shared key is required to authenticate the key exchange")
+)
+
+// IsPreface reports whether b starts like an encrypted tunnel preface
+func IsPreface(b []byte) bool {
+	return len(b) >= len(prefaceMagic) && b[0] == prefaceMagic[0] && b[1] == prefaceMagic[1]
+}
+
+// CipherByName returns the cipher id of "chacha20-poly1305" or "aes-256-gcm"
+func CipherByName(name string) (byte, error) {
+	switch name {
+	case "chacha20-poly1305":
+		return ChaCha20Poly1305, nil
+	case "aes-256-gcm":
+		return AES256GCM, nil
+	default:
+		return 0, fmt.Errorf("aead: unknown cipher %q", name)
+	}
+}
+
+// Conn encrypts everything written to and decrypts everything read from the
+// underlying connection
+type Conn struct {
+	net.Conn
+
+	readMutex sync.Mutex
+	reader    cipher.AEAD
+	readNonce []byte
+	readBuf   []byte
+	pending   []byte
+
+	writeMutex sync.Mutex
+	writer     cipher.AEAD
+	writeNonce []byte
+	writeBuf   []byte
+}
+
+// Client runs the client side of the key exchange over conn
+func Client(conn net.Conn, cipherID byte, psk []byte) (*Conn, error) {
+	if len(psk) == 0 {
+		return nil, ErrNoPSK
+	}
+	priv, pub, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(preface(cipherID, pub)); err != nil {
+		return nil, err
+	}
+
+	peerCipher, peerPub, err := readPreface(conn)
+	if err != nil {
+		return nil, err
+	}
+	if peerCipher != cipherID {
+		return nil, ErrUnsupportedCipher
+	}
+	return newConn(conn, cipherID, psk, priv, peerPub, pub, peerPub, true)
+}
+
+// Server runs the server side of the key exchange over conn, the cipher is
+// chosen by the client
+func Server(conn net.Conn, psk []byte) (*Conn, error) {
+	if len(psk) == 0 {
+		return nil, ErrNoPSK
+	}
+	cipherID, peerPub, err := readPreface(conn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := newAEAD(cipherID, make([]byte, keySize)); err != nil {
+		return nil, err
+	}
+
+	priv, pub, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(preface(cipherID, pub)); err != nil {
+		return nil, err
+	}
+	return newConn(conn, cipherID, psk, priv, peerPub, peerPub, pub, false)
+}
+
+func newConn(conn net.Conn, cipherID byte, psk, priv, peerPub, clientPub, serverPub []byte, isClient bool) (*Conn, error) {
+	shared, err := curve25519.X25519(priv, peerPub)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := sha256.Sum256(psk)
+	kdf := hkdf.New(sha256.New, shared, salt[:], append(append([]byte(info), clientPub...), serverPub...))
+	keys := make([]byte, 2*keySize)
+	if _, err := io.ReadFull(kdf, keys); err != nil {
+		return nil, err
+	}
+	clientKey, serverKey := keys[:keySize], keys[keySize:]
+	if !isClient {
+		clientKey, serverKey = serverKey, clientKey
+	}
+
+	writer, err := newAEAD(cipherID, clientKey)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := newAEAD(cipherID, serverKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Conn{
+		Conn:       conn,
+		reader:     reader,
+		readNonce:  make([]byte, reader.NonceSize()),
+		readBuf:    make([]byte, 2+MaxPayloadSize+reader.Overhead()),
+		writer:     writer,
+		writeNonce: make([]byte, writer.NonceSize()),
+		writeBuf:   make([]byte, 2+MaxPayloadSize+writer.Overhead()),
+	}, nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+
+	if len(c.pending) == 0 {
+		if _, err := io.ReadFull(c.Conn, c.readBuf[:2]); err != nil {
+			return 0, err
+		}
+		size := int(binary.BigEndian.Uint16(c.readBuf))
+		if size < c.reader.Overhead() || size > MaxPayloadSize+c.reader.Overhead() {
+			return 0, errors.New("aead: invalid record size")
+		}
+		record := c.readBuf[2 : 2+size]
+		if _, err := io.ReadFull(c.Conn, record); err != nil {
+			return 0, err
+		}
+		plain, err := c.reader.Open(record[:0], c.readNonce, record, nil)
+		if err != nil {
+			return 0, err
+		}
+		increment(c.readNonce)
+		c.pending = plain
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	written := 0
+	for written < len(b) {
+		n := len(b) - written
+		if n > MaxPayloadSize {
+			n = MaxPayloadSize
+		}
+		sealed := c.writer.Seal(c.writeBuf[2:2], c.writeNonce, b[written:written+n], nil)
+		increment(c.writeNonce)
+		binary.BigEndian.PutUint16(c.writeBuf, uint16(len(sealed)))
+		if _, err := c.Conn.Write(c.writeBuf[:2+len(sealed)]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+func newKeyPair() (priv, pub []byte, err error) {
+	priv = make([]byte, curve25519.ScalarSize)
+	if _, err = rand.Read(priv); err != nil {
+		return nil, nil, err
+	}
+	pub, err = curve25519.X25519(priv, curve25519.Basepoint)
+	return priv, pub, err
+}
+
+func newAEAD(cipherID byte, key []byte) (cipher.AEAD, error) {
+	switch cipherID {
+	case ChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	case AES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	default:
+		return nil, ErrUnsupportedCipher
+	}
+}
+
+func preface(cipherID byte, pub []byte) []byte {
+	b := make([]byte, 0, prefaceSize)
+	b = append(b, prefaceMagic...)
+	b = append(b, cipherID)
+	return append(b, pub...)
+}
+
+func readPreface(r io.Reader) (byte, []byte, error) {
+	b := make([]byte, prefaceSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, nil, err
+	}
+	if !IsPreface(b) {
+		return 0, nil, ErrBadPreface
+	}
+	return b[2], b[3:], nil
+}
+
+func increment(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package aead
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+)
+
+// handshake runs both sides of the key exchange over an in-memory connection
+func handshake(t *testing.T, cipherID byte, clientPSK, serverPSK []byte) (*Conn, *Conn) {
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+	return handshakeOver(t, c1, c2, cipherID, clientPSK, serverPSK)
+}
+
+func handshakeOver(t *testing.T, c1, c2 net.Conn, cipherID byte, clientPSK, serverPSK []byte) (*Conn, *Conn) {
+	type result struct {
+		conn *Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := Server(c2, serverPSK)
+		done <- result{conn, err}
+	}()
+	client, err := Client(c1, cipherID, clientPSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	return client, r.conn
+}
+
+func randomData(t *testing.T, size int) []byte {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, name := range []string{"chacha20-poly1305", "aes-256-gcm"} {
+		cipherID, err := CipherByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, server := handshake(t, cipherID, []byte("secret"), []byte("secret"))
+
+		// several records in each direction, the last of them partial
+		for _, dir := range []struct{ w, r *Conn }{{client, server}, {server, client}} {
+			data := randomData(t, 3*MaxPayloadSize+100)
+			go dir.w.Write(data)
+			out := make([]byte, len(data))
+			if _, err := io.ReadFull(dir.r, out); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if !bytes.Equal(out, data) {
+				t.Fatalf("%s: decrypted other data", name)
+			}
+		}
+	}
+}
+
+func TestWrongPSK(t *testing.T) {
+	client, server := handshake(t, ChaCha20Poly1305, []byte("secret"), []byte("other"))
+
+	go client.Write([]byte("hello"))
+	if _, err := server.Read(make([]byte, 5)); err == nil {
+		t.Fatal("a record sealed with another pre-shared key was opened")
+	}
+}
+
+func TestNoPSK(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	if _, err := Client(c1, ChaCha20Poly1305, nil); err != ErrNoPSK {
+		t.Fatalf("Client returned %v instead of ErrNoPSK", err)
+	}
+	if _, err := Server(c2, nil); err != ErrNoPSK {
+		t.Fatalf("Server returned %v instead of ErrNoPSK", err)
+	}
+}
+
+// tamperConn flips a bit of the last byte of every write after the first one
+type tamperConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *tamperConn) Write(b []byte) (int, error) {
+	c.writes++
+	if c.writes > 1 {
+		b = append([]byte(nil), b...)
+		b[len(b)-1] ^= 1
+	}
+	return c.Conn.Write(b)
+}
+
+func TestTamperedRecord(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	client, server := handshakeOver(t, &tamperConn{Conn: c1}, c2, AES256GCM, []byte("secret"), []byte("secret"))
+
+	go client.Write([]byte("hello"))
+	if _, err := server.Read(make([]byte, 5)); err == nil {
+		t.Fatal("a tampered record was opened")
+	}
+}
+
+func TestBadPreface(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go c1.Write(append([]byte("GET / HTTP/1.1\r\n"), make([]byte, prefaceSize)...))
+	if _, err := Server(c2, []byte("secret")); err != ErrBadPreface {
+		t.Fatalf("Server returned %v instead of ErrBadPreface", err)
+	}
+}
+
+func TestUnsupportedCipher(t *testing.T) {
+	if _, err := CipherByName("rc4"); err == nil {
+		t.Fatal("an unknown cipher name was accepted")
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go Client(c1, 0x7f, []byte("secret"))
+	if _, err := Server(c2, []byte("secret")); err != ErrUnsupportedCipher {
+		t.Fatalf("Server returned %v instead of ErrUnsupportedCipher", err)
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	nonce := []byte{0xff, 0xff, 0x00}
+	increment(nonce)
+	if !bytes.Equal(nonce, []byte{0x00, 0x00, 0x01}) {
+		t.Fatalf("the nonce is %x after the carry", nonce)
+	}
+}
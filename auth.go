@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// When FlagAuth is set, the handshake request is followed by an auth block:
+//
+// +-----------+-------+-----+
+// | TIMESTAMP | NONCE | MAC |
+// +-----------+-------+-----+
+// |     8     |  16   | 32  |
+// +-----------+-------+-----+
+//
+//   - TIMESTAMP is the big endian unix time of the client in seconds
+//   - NONCE is random and never accepted twice within AuthWindow
+//   - MAC is HMAC-SHA256 keyed with the pre-shared key over every byte of the
+//     handshake request from MAGIC up to and including NONCE
+const (
+	authNonceSize = 16
+	authMACSize   = sha256.Size
+	authBlockSize = 8 + authNonceSize + authMACSize
+)
+
+// AuthWindow is how far the client clock may drift from the server clock
+const AuthWindow = 90 * time.Second
+
+// upgradeCookie carries the upgrade token of authenticated clients, it's an
+// auth block signing upgradeDomain so that the server can tell tunnels from
+// probes before it upgrades the connection
+const (
+	upgradeCookie = "sid"
+	upgradeDomain = "egg upgrade"
+)
+
+var (
+	ErrAuthRequired = errors.New("auth: server requires authentication")
+	ErrAuthExpired  = errors.New("auth: timestamp outside of the allowed window")
+	ErrAuthReplayed = errors.New("auth: nonce has been used before")
+	ErrAuthBadMAC   = errors.New("auth: invalid mac")
+)
+
+// PSKAuth signs and verifies handshakes with a pre-shared key
+type PSKAuth struct {
+	key []byte
+	// nonces remembers the nonces seen within the window, only used by the server
+	nonces *Cache
+}
+
+func NewPSKAuth(secret string) *PSKAuth {
+	// nonces older than the window are rejected by their timestamp, so they
+	// don't need to be remembered any longer than that
+	nonces := NewCache(2 * AuthWindow)
+	nonces.OnExpired(nonces.DeleteExpired)
+	return &PSKAuth{
+		key:    []byte(secret),
+		nonces: nonces,
+	}
+}
+
+// sign returns the auth block for the handshake request msg
+func (a *PSKAuth) sign(msg []byte) ([]byte, error) {
+	block := make([]byte, 8+authNonceSize, authBlockSize)
+	binary.BigEndian.PutUint64(block, uint64(time.Now().Unix()))
+	if _, err := rand.Read(block[8:]); err != nil {
+		return nil, err
+	}
+	return append(block, a.mac(msg, block[:8+authNonceSize])...), nil
+}
+
+// verify checks the auth block of the handshake request msg
+func (a *PSKAuth) verify(msg []byte, block []byte) error {
+	if !hmac.Equal(a.mac(msg, block[:8+authNonceSize]), block[8+authNonceSize:]) {
+		return ErrAuthBadMAC
+	}
+
+	ts := time.Unix(int64(binary.BigEndian.Uint64(block)), 0)
+	if d := time.Since(ts); d > AuthWindow || d < -AuthWindow {
+		return ErrAuthExpired
+	}
+
+	if err := a.nonces.Add(hex.EncodeToString(block[8:8+authNonceSize]), ts); err != nil {
+		return ErrAuthReplayed
+	}
+	return nil
+}
+
+func (a *PSKAuth) mac(msg []byte, tsAndNonce []byte) []byte {
+	h := hmac.New(sha256.New, a.key)
+	h.Write(msg)
+	h.Write(tsAndNonce)
+	return h.Sum(nil)
+}
+
+// upgradeToken returns a fresh token for the upgrade request of a tunnel
+func (a *PSKAuth) upgradeToken() (string, error) {
+	block, err := a.sign([]byte(upgradeDomain))
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(block), nil
+}
+
+// verifyUpgradeToken checks the token of an upgrade request
+func (a *PSKAuth) verifyUpgradeToken(token string) error {
+	block, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(block) != authBlockSize {
+		return ErrAuthRequired
+	}
+	return a.verify([]byte(upgradeDomain), block)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestPathReqAuth(t *testing.T) {
+	q := &PathReq{Id: "id", Dest: "example.com:443", Net: TCP, PType: TwoWay, Stripes: 1}
+	server := NewPSKAuth("secret")
+
+	tests := []struct {
+		name string
+		req  []byte
+		err  error
+	}{
+		{"unsigned", encodePathReq(t, q, nil), ErrAuthRequired},
+		{"other key", encodePathReq(t, q, NewPSKAuth("other")), ErrAuthBadMAC},
+		{"tampered", func() []byte {
+			b := encodePathReq(t, q, NewPSKAuth("secret"))
+			b[handshakeHeaderSize] ^= 1
+			return b
+		}(), ErrAuthBadMAC},
+	}
+	for _, tt := range tests {
+		_, err := readPathReq(bytes.NewReader(tt.req), server)
+		if handshakeStatus(err) != int(StatusUnauthorized) || err.Error() != tt.err.Error() {
+			t.Fatalf("%s: got %v instead of %v", tt.name, err, tt.err)
+		}
+	}
+
+	// a signed request is accepted once
+	signed := encodePathReq(t, q, NewPSKAuth("secret"))
+	if _, err := readPathReq(bytes.NewReader(signed), server); err != nil {
+		t.Fatal(err)
+	}
+	_, err := readPathReq(bytes.NewReader(signed), server)
+	if handshakeStatus(err) != int(StatusUnauthorized) || err.Error() != ErrAuthReplayed.Error() {
+		t.Fatalf("a replayed request got %v instead of %v", err, ErrAuthReplayed)
+	}
+}
+
+func TestAuthExpired(t *testing.T) {
+	auth := NewPSKAuth("secret")
+	msg := []byte("request")
+
+	for _, age := range []time.Duration{2 * AuthWindow, -2 * AuthWindow} {
+		block := make([]byte, 8+authNonceSize, authBlockSize)
+		binary.BigEndian.PutUint64(block, uint64(time.Now().Add(-age).Unix()))
+		block = append(block, auth.mac(msg, block)...)
+		if err := auth.verify(msg, block); err != ErrAuthExpired {
+			t.Fatalf("a block %v old got %v instead of ErrAuthExpired", age, err)
+		}
+	}
+}
+
+func TestUpgradeToken(t *testing.T) {
+	server := NewPSKAuth("secret")
+
+	token, err := NewPSKAuth("secret").upgradeToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.verifyUpgradeToken(token); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.verifyUpgradeToken(token); err != ErrAuthReplayed {
+		t.Fatalf("a reused token got %v instead of ErrAuthReplayed", err)
+	}
+
+	other, err := NewPSKAuth("other").upgradeToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.verifyUpgradeToken(other); err != ErrAuthBadMAC {
+		t.Fatalf("a token of another key got %v instead of ErrAuthBadMAC", err)
+	}
+	for _, token := range []string{"", "not base64!", base64.RawURLEncoding.EncodeToString(bytes.Repeat([]byte{1}, 8))} {
+		if err := server.verifyUpgradeToken(token); err != ErrAuthRequired {
+			t.Fatalf("token %q got %v instead of ErrAuthRequired", token, err)
+		}
+	}
+
+	// a handshake signature isn't an upgrade token
+	block, err := server.sign([]byte("request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.verifyUpgradeToken(base64.RawURLEncoding.EncodeToString(block)); err != ErrAuthBadMAC {
+		t.Fatalf("a handshake signature got %v instead of ErrAuthBadMAC", err)
+	}
+}
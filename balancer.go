@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// balancing strategies, they decide which server a connection is tunneled to
+const (
+	RoundRobin = "round-robin"
+	Random     = "random"
+	LeastConn  = "least-conn"
+	LowestRTT  = "rtt"
+)
+
+// maxDialFailures is how many dials in a row may fail before a server is
+// considered down, it's probed again until it answers
+const maxDialFailures = 3
+
+// upstream is one of the servers a client tunnels to, with its own transports
+type upstream struct {
+	endpoint string
+	// transports holds the transport of every path type, it's a TwoWay one
+	// unless connections are split
+	transports map[PathType]Transport
+	split      bool
+	// muxPools holds multiplexed tunnels per path type, it's nil when multiplexing is disabled
+	muxPools map[PathType]*MuxPool
+	// idlePools holds ready tunnels per path type, it's nil when the pool is disabled
+	idlePools map[PathType]*IdlePool
+
+	// active is the number of open tunnels
+	active int64
+
+	mutex    sync.Mutex
+	failures int
+	down     bool
+	// rtt is the smoothed round trip time of pings, 0 until it's measured
+	rtt time.Duration
+}
+
+// dial returns a tunnel for a single connection, it's either a stream of a
+// multiplexed tunnel or a dedicated one, which may have been dialed ahead of time
+func (u *upstream) dial(pathType PathType) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if mp, ok := u.muxPools[pathType]; ok {
+		conn, err = mp.OpenStream()
+	} else if pool, ok := u.idlePools[pathType]; ok {
+		conn, err = pool.Get()
+	} else if t, ok := u.transports[pathType]; ok {
+		conn, err = t.Dial(pathType)
+	} else {
+		return nil, fmt.Errorf("server %s has no path of type %d", u.endpoint, pathType)
+	}
+	u.report(err)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&u.active, 1)
+	return &trackedConn{Conn: conn, u: u}, nil
+}
+
+// report records the outcome of a dial, the server is marked down after too many failures
+func (u *upstream) report(err error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if err == nil {
+		if u.down {
+			fmt.Printf("server %s is up again\n", u.endpoint)
+		}
+		u.failures = 0
+		u.down = false
+		return
+	}
+	u.failures++
+	if !u.down && u.failures >= maxDialFailures {
+		fmt.Printf("server %s is down: %v\n", u.endpoint, err)
+		u.down = true
+	}
+}
+
+func (u *upstream) isDown() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.down
+}
+
+func (u *upstream) getRTT() time.Duration {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.rtt
+}
+
+// probe dials a tunnel and pings the server over it, it updates the health
+// and the rtt. split servers are probed over their download path
+func (u *upstream) probe(auth *PSKAuth) {
+	pathType := TwoWay
+	if u.split {
+		pathType = Download
+	}
+	conn, err := u.transports[pathType].Dial(pathType)
+	if err != nil {
+		u.report(err)
+		return
+	}
+	defer conn.Close()
+	start := time.Now()
+	err = pingTunnel(conn, auth)
+	sample := time.Since(start)
+	u.report(err)
+	if err != nil {
+		return
+	}
+
+	u.mutex.Lock()
+	if u.rtt == 0 {
+		u.rtt = sample
+	} else {
+		u.rtt = (7*u.rtt + sample) / 8
+	}
+	u.mutex.Unlock()
+}
+
+// trackedConn counts the open tunnels of an upstream
+type trackedConn struct {
+	net.Conn
+	u         *upstream
+	closeOnce sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(func() {
+		atomic.AddInt64(&c.u.active, -1)
+	})
+	return c.Conn.Close()
+}
+
+// Balancer picks the server of every connection, servers that are down are
+// skipped unless all of them are
+type Balancer struct {
+	strategy  string
+	upstreams []*upstream
+	auth      *PSKAuth
+	// next is the round robin counter
+	next uint32
+}
+
+func NewBalancer(strategy string, upstreams []*upstream, auth *PSKAuth, probeInterval time.Duration) (*Balancer, error) {
+	switch strategy {
+	case RoundRobin, Random, LeastConn, LowestRTT:
+	default:
+		return nil, fmt.Errorf("unknown balancing strategy %q", strategy)
+	}
+	if len(upstreams) == 0 {
+		return nil, errors.New("no servers to tunnel to")
+	}
+	b := &Balancer{
+		strategy:  strategy,
+		upstreams: upstreams,
+		auth:      auth,
+	}
+	if len(upstreams) > 1 {
+		go b.probeLoop(probeInterval)
+	}
+	return b, nil
+}
+
+// Pick returns the server for a new connection, the servers in tried are
+// only picked again when there's no other one left
+func (b *Balancer) Pick(tried ...*upstream) *upstream {
+	candidates := b.filter(func(u *upstream) bool { return !u.isDown() && !contains(tried, u) })
+	if len(candidates) == 0 {
+		candidates = b.filter(func(u *upstream) bool { return !contains(tried, u) })
+	}
+	if len(candidates) == 0 {
+		candidates = b.filter(func(u *upstream) bool { return !u.isDown() })
+	}
+	if len(candidates) == 0 {
+		candidates = b.upstreams
+	}
+
+	switch b.strategy {
+	case Random:
+		return candidates[rand.Intn(len(candidates))]
+	case LeastConn:
+		best := candidates[0]
+		for _, u := range candidates[1:] {
+			if atomic.LoadInt64(&u.active) < atomic.LoadInt64(&best.active) {
+				best = u
+			}
+		}
+		return best
+	case LowestRTT:
+		// servers that haven't been measured yet are tried first
+		best := candidates[0]
+		for _, u := range candidates[1:] {
+			if u.getRTT() < best.getRTT() {
+				best = u
+			}
+		}
+		return best
+	default:
+		n := atomic.AddUint32(&b.next, 1)
+		return candidates[int(n-1)%len(candidates)]
+	}
+}
+
+func (b *Balancer) filter(keep func(u *upstream) bool) []*upstream {
+	var upstreams []*upstream
+	for _, u := range b.upstreams {
+		if keep(u) {
+			upstreams = append(upstreams, u)
+		}
+	}
+	return upstreams
+}
+
+func contains(upstreams []*upstream, u *upstream) bool {
+	for _, v := range upstreams {
+		if v == u {
+			return true
+		}
+	}
+	return false
+}
+
+// probeLoop probes the servers that are down, and every server when the
+// strategy needs their rtt
+func (b *Balancer) probeLoop(interval time.Duration) {
+	for {
+		var wg sync.WaitGroup
+		for _, u := range b.upstreams {
+			if b.strategy != LowestRTT && !u.isDown() {
+				continue
+			}
+			wg.Add(1)
+			go func(u *upstream) {
+				defer wg.Done()
+				u.probe(b.auth)
+			}(u)
+		}
+		wg.Wait()
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+var errUnreachable = errors.New("unreachable")
+
+// fakeUpstream returns a server whose tunnels are in-memory pipes, or fail
+// while *failing is set
+func fakeUpstream(name string, failing *bool) *upstream {
+	return &upstream{
+		endpoint: name,
+		transports: map[PathType]Transport{
+			TwoWay: TransportFunc(func(PathType) (net.Conn, error) {
+				if failing != nil && *failing {
+					return nil, errUnreachable
+				}
+				conn, _ := net.Pipe()
+				return conn, nil
+			}),
+		},
+	}
+}
+
+func balancer(t *testing.T, strategy string, upstreams ...*upstream) *Balancer {
+	b, err := NewBalancer(strategy, upstreams, nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestBalancerStrategies(t *testing.T) {
+	if _, err := NewBalancer("fastest", []*upstream{fakeUpstream("a", nil)}, nil, time.Hour); err == nil {
+		t.Fatal("an unknown strategy was accepted")
+	}
+	if _, err := NewBalancer(RoundRobin, nil, nil, time.Hour); err == nil {
+		t.Fatal("a balancer without servers was accepted")
+	}
+
+	a, b, c := fakeUpstream("a", nil), fakeUpstream("b", nil), fakeUpstream("c", nil)
+	rr := balancer(t, RoundRobin, a, b, c)
+	for i, want := range []*upstream{a, b, c, a, b} {
+		if got := rr.Pick(); got != want {
+			t.Fatalf("pick %d: got %s instead of %s", i, got.endpoint, want.endpoint)
+		}
+	}
+
+	lc := balancer(t, LeastConn, a, b)
+	conn, err := a.dial(TwoWay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lc.Pick(); got != b {
+		t.Fatalf("least-conn picked %s with a busier server", got.endpoint)
+	}
+	conn.Close()
+	conn.Close()
+	if a.active != 0 {
+		t.Fatalf("%d tunnels are counted after closing the only one", a.active)
+	}
+
+	// servers that haven't been measured yet are tried first
+	a.rtt, b.rtt = 50*time.Millisecond, 10*time.Millisecond
+	rtt := &Balancer{strategy: LowestRTT, upstreams: []*upstream{a, b, c}}
+	if got := rtt.Pick(); got != c {
+		t.Fatalf("rtt picked %s before the unmeasured server", got.endpoint)
+	}
+	c.rtt = 30 * time.Millisecond
+	if got := rtt.Pick(); got != b {
+		t.Fatalf("rtt picked %s instead of the fastest server", got.endpoint)
+	}
+}
+
+func TestBalancerDown(t *testing.T) {
+	failing := true
+	a, b := fakeUpstream("a", &failing), fakeUpstream("b", nil)
+	lb := balancer(t, RoundRobin, a, b)
+
+	for i := 0; i < maxDialFailures; i++ {
+		if a.isDown() {
+			t.Fatalf("the server is down after %d failures", i)
+		}
+		if _, err := a.dial(TwoWay); err != errUnreachable {
+			t.Fatalf("dial returned %v", err)
+		}
+	}
+	if !a.isDown() {
+		t.Fatal("the server isn't down after failing repeatedly")
+	}
+	for i := 0; i < 3; i++ {
+		if lb.Pick() != b {
+			t.Fatal("a server that is down was picked")
+		}
+	}
+	// servers already tried are picked again only when nothing else is left,
+	// even if they're down
+	if lb.Pick(b) != a {
+		t.Fatal("the only server not tried yet wasn't picked")
+	}
+	if lb.Pick(a, b) != b {
+		t.Fatal("a server that is down was picked over one that is up")
+	}
+
+	failing = false
+	if _, err := a.dial(TwoWay); err != nil {
+		t.Fatal(err)
+	}
+	if a.isDown() {
+		t.Fatal("the server is still down after a successful dial")
+	}
+}
@@ -38,7 +38,10 @@ type cache struct {
 // Set add an item to the cache, replacing any existing item.
 func (c *cache) Set(k string, x interface{}) {
 	// "Inlining" of set
-	var e = time.Now().Add(c.expiration).UnixNano()
+	var e int64
+	if c.expiration > 0 {
+		e = time.Now().Add(c.expiration).UnixNano()
+	}
 
 	c.mu.Lock()
 	c.items[k] = Item{
@@ -51,13 +54,30 @@ func (c *cache) Set(k string, x interface{}) {
 }
 
 func (c *cache) set(k string, x interface{}) {
-	var e = time.Now().Add(c.expiration).UnixNano()
+	var e int64
+	if c.expiration > 0 {
+		e = time.Now().Add(c.expiration).UnixNano()
+	}
 	c.items[k] = Item{
 		Object:     x,
 		Expiration: e,
 	}
 }
 
+// Add an item to the cache only if an item doesn't already exist for the given
+// key, or if the existing item has expired. Returns an error otherwise.
+func (c *cache) Add(k string, x interface{}) error {
+	c.mu.Lock()
+	item, found := c.items[k]
+	if found && !item.Expired() {
+		c.mu.Unlock()
+		return fmt.Errorf("item %s already exists", k)
+	}
+	c.set(k, x)
+	c.mu.Unlock()
+	return nil
+}
+
 // Replace set a new value for the cache key only if it already exists. Returns an error otherwise.
 func (c *cache) Replace(k string, x interface{}) error {
 	c.mu.Lock()
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServerTLSOptions controls how the server terminates TLS, it's disabled when
+// neither certificate files, a self-signed certificate nor ACME are configured
+type ServerTLSOptions struct {
+	CertFile string
+	KeyFile  string
+	// SelfSigned generates a certificate for Hosts, it's stored in CertFile and
+	// KeyFile when they're set so that its fingerprint survives restarts
+	SelfSigned bool
+	Hosts      []string
+
+	ACMEDomains   []string
+	ACMEEmail     string
+	ACMEDirectory string
+	ACMECache     string
+	// ACMECAFile is a PEM bundle to trust when talking to the ACME directory, ex. a local Pebble
+	ACMECAFile string
+	// ACMEHTTPBind is where HTTP-01 challenges are served, TLS-ALPN-01 is always served on the TLS listener
+	ACMEHTTPBind string
+}
+
+// serverALPN prefers HTTP/2 like ordinary web servers do, websocket clients
+// only offer HTTP/1.1 and HTTP/2 tunnels need h2
+var serverALPN = []string{"h2", "http/1.1"}
+
+// certCheckInterval is how often certificate files are checked for changes
+const certCheckInterval = 10 * time.Second
+
+// newServerTLSConfig returns the TLS config of the server, or nil if TLS is disabled
+func newServerTLSConfig(opts ServerTLSOptions) (*tls.Config, error) {
+	switch {
+	case len(opts.ACMEDomains) > 0:
+		return newACMEConfig(opts)
+	case opts.SelfSigned:
+		cert, err := selfSignedCertificate(opts)
+		if err != nil {
+			return nil, err
+		}
+		printFingerprints(cert)
+		return &tls.Config{
+			Certificates: []tls.Certificate{*cert},
+			NextProtos:   serverALPN,
+		}, nil
+	case opts.CertFile != "" || opts.KeyFile != "":
+		cr := &certReloader{certFile: opts.CertFile, keyFile: opts.KeyFile}
+		if err := cr.reload(); err != nil {
+			return nil, err
+		}
+		return &tls.Config{
+			GetCertificate: cr.GetCertificate,
+			NextProtos:     serverALPN,
+		}, nil
+	default:
+		return nil, nil
+	}
+}
+
+func newACMEConfig(opts ServerTLSOptions) (*tls.Config, error) {
+	client := &acme.Client{DirectoryURL: opts.ACMEDirectory}
+	if opts.ACMECAFile != "" {
+		bundle, err := os.ReadFile(opts.ACMECAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read acme ca bundle: %v", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.ACMECAFile)
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			},
+		}
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(opts.ACMEDomains...),
+		Cache:      autocert.DirCache(opts.ACMECache),
+		Email:      opts.ACMEEmail,
+		Client:     client,
+	}
+
+	if opts.ACMEHTTPBind != "" {
+		go func() {
+			fmt.Printf("Serving ACME http challenges at %s ...\n", opts.ACMEHTTPBind)
+			if err := http.ListenAndServe(opts.ACMEHTTPBind, m.HTTPHandler(nil)); err != nil {
+				fmt.Printf("unable to serve ACME http challenges: %v\n", err)
+			}
+		}()
+	}
+
+	config := m.TLSConfig()
+	// acme-tls/1 is kept for TLS-ALPN-01 challenges
+	config.NextProtos = append(append([]string{}, serverALPN...), acme.ALPNProto)
+	return config, nil
+}
+
+// certReloader serves a certificate from files and reloads it once they change
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex   sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	if time.Since(cr.checked) > certCheckInterval {
+		cr.checked = time.Now()
+		if modTime, err := cr.lastModified(); err == nil && !modTime.Equal(cr.modTime) {
+			if err := cr.load(); err != nil {
+				// keep serving the previous certificate, the files may be half written
+				fmt.Printf("unable to reload certificate: %v\n", err)
+			} else {
+				fmt.Printf("certificate %s reloaded\n", cr.certFile)
+			}
+		}
+	}
+	return cr.cert, nil
+}
+
+func (cr *certReloader) reload() error {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	cr.checked = time.Now()
+	return cr.load()
+}
+
+func (cr *certReloader) load() error {
+	modTime, err := cr.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.cert, cr.modTime = &cert, modTime
+	return nil
+}
+
+func (cr *certReloader) lastModified() (time.Time, error) {
+	var last time.Time
+	for _, name := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return last, err
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last, nil
+}
+
+// selfSignedCertificate loads the self-signed certificate from its files, or
+// generates a new one and stores it there
+func selfSignedCertificate(opts ServerTLSOptions) (*tls.Certificate, error) {
+	persist := opts.CertFile != "" && opts.KeyFile != ""
+	if persist {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err == nil {
+			return &cert, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := opts.Hosts
+	if len(hosts) == 0 {
+		hosts = []string{"localhost"}
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[0]},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	if persist {
+		if err := os.WriteFile(opts.CertFile, certPEM, 0644); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(opts.KeyFile, keyPEM, 0600); err != nil {
+			return nil, err
+		}
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// printFingerprints prints the fingerprints clients can pin with --pin-cert and --pin-pubkey
+func printFingerprints(cert *tls.Certificate) {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return
+	}
+	certSum := sha256.Sum256(leaf.Raw)
+	keySum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+
+	parts := make([]string, len(certSum))
+	for i, b := range certSum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	fmt.Printf("self-signed certificate for %s\n", strings.Join(append(leaf.DNSNames, ipStrings(leaf.IPAddresses)...), ", "))
+	fmt.Printf("  certificate SHA-256: %s\n", strings.Join(parts, ":"))
+	fmt.Printf("  public key SHA-256:  %s\n", base64.StdEncoding.EncodeToString(keySum[:]))
+}
+
+func ipStrings(ips []net.IP) []string {
+	s := make([]string, len(ips))
+	for i, ip := range ips {
+		s[i] = ip.String()
+	}
+	return s
+}
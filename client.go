@@ -1,20 +1,271 @@
 package main
 
 import (
+	"egg/aead"
 	"egg/socks5"
+	"errors"
+	"fmt"
+	tls "github.com/refraction-networking/utls"
+	"net"
+	"net/url"
+	"strings"
+	"time"
 )
 
-func NewClient(endpoint string, relayEnabled bool) (*socks5.Server, error) {
+// ClientConfig holds the settings of a client instance
+type ClientConfig struct {
+	// Servers are the servers to tunnel to
+	Servers []UpstreamConfig
+	// Balance is the strategy picking the server of a connection, see Balancer
+	Balance string
+	// ProbeInterval is how often servers that are down are probed, and every
+	// server with the rtt strategy
+	ProbeInterval time.Duration
+	// MuxConns is the number of multiplexed tunnels, 0 disables multiplexing
+	MuxConns int
+	// IdleConns is the number of tunnels kept ready per path type, 0 disables
+	// the pool. it doesn't apply to multiplexed tunnels
+	IdleConns int
+	// IdleMaxAge is how long an idle tunnel is kept before it's replaced
+	IdleMaxAge time.Duration
+	// IdlePing is how often idle tunnels are pinged, it must be shorter than TunnelIdleTimeout
+	IdlePing time.Duration
+	// DownloadStripes is the number of download paths a tcp connection is
+	// striped over, UploadStripes the number of its upload paths. connections
+	// are split when either is more than 1
+	DownloadStripes int
+	UploadStripes   int
+	// Relays controls the relay pools of endpoints with several relays
+	Relays RelayOptions
+	// Retry controls how failed tunnels are retried
+	Retry RetryOptions
+	// Optimistic replies to socks clients before the server dials the destination
+	Optimistic bool
+	// Secret is the pre-shared key tunnels are authenticated with, empty disables authentication
+	Secret string
+	// Encryption is the cipher of the inner encryption layer, empty disables it
+	Encryption string
+	TLS        TLSOptions
+	// Fingerprint is the name of a uTLS preset, FingerprintFile a custom ClientHello spec overriding it
+	Fingerprint     string
+	FingerprintFile string
+	Fronting        FrontingOptions
+}
+
+// UpstreamConfig is a server to tunnel to, see parseEndpoint for the settings
+// its endpoints may carry
+type UpstreamConfig struct {
+	Endpoint string
+	// Upload and Download split every connection over two independent paths,
+	// ex. to send the upload through a relay. an empty one uses Endpoint for
+	// its direction, and connections aren't split unless one of them is set.
+	// both paths must end at the same server, since it pairs them
+	Upload   string
+	Download string
+}
+
+type Client struct {
+	cfg      ClientConfig
+	auth     *PSKAuth
+	balancer *Balancer
+}
+
+func NewClient(cfg ClientConfig) (*socks5.Server, error) {
+	tlsConfig, err := newTLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	var auth *PSKAuth
+	if cfg.Secret != "" {
+		auth = NewPSKAuth(cfg.Secret)
+	}
+	if cfg.IdleConns > 0 && (cfg.IdlePing <= 0 || cfg.IdlePing >= TunnelIdleTimeout) {
+		return nil, fmt.Errorf("idle tunnels must be pinged more often than every %v", TunnelIdleTimeout)
+	}
+
+	if cfg.DownloadStripes > MaxStripes || cfg.UploadStripes > MaxStripes {
+		return nil, fmt.Errorf("connections can be striped over at most %d paths", MaxStripes)
+	}
+
 	fifo := NewFIFO()
 	cp := NewConnectionPool()
 	h := Handle{
 		cp,
 		fifo,
+		cfg.Optimistic,
 	}
 	s5 := socks5.NewServer(
 		socks5.WithConnectHandle(h.handleTCPConnect),
 		socks5.WithAssociateHandle(h.handleUDPAssociate),
 	)
-	go Scheduler(fifo, cp, endpoint, relayEnabled)
+	c := &Client{
+		cfg:  cfg,
+		auth: auth,
+	}
+	upstreams := make([]*upstream, 0, len(cfg.Servers))
+	for _, server := range cfg.Servers {
+		u, err := c.newUpstream(server, tlsConfig)
+		if err != nil {
+			return nil, fmt.Errorf("server %s: %v", server.Endpoint, err)
+		}
+		upstreams = append(upstreams, u)
+	}
+	if c.balancer, err = NewBalancer(cfg.Balance, upstreams, auth, cfg.ProbeInterval); err != nil {
+		return nil, err
+	}
+	go Scheduler(fifo, cp, c)
 	return s5, nil
 }
+
+// parseEndpoint splits the per-server settings off an endpoint, they're given
+// as a fragment that overrides the client-wide ones, ex.
+// wss://example.com/ws#connect=1.2.3.4&sni=cdn.example.net&host=example.com&fingerprint=chrome
+// relays=<addr>,<addr> rotates the connect address over relays, see RelayPool
+func parseEndpoint(endpoint string, fronting FrontingOptions, fingerprint string) (string, FrontingOptions, string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fronting, "", err
+	}
+	if u.Fragment == "" {
+		return endpoint, fronting, fingerprint, nil
+	}
+	opts, err := url.ParseQuery(u.Fragment)
+	if err != nil {
+		return "", fronting, "", fmt.Errorf("invalid server settings %q", u.Fragment)
+	}
+	for key, values := range opts {
+		value := values[len(values)-1]
+		switch key {
+		case "connect":
+			fronting.ConnectAddr = value
+		case "relays":
+			fronting.Relays = strings.Split(value, ",")
+		case "sni":
+			fronting.SNI = value
+		case "host":
+			fronting.Host = value
+		case "fingerprint":
+			fingerprint = value
+		default:
+			return "", fronting, "", fmt.Errorf("unknown server setting %q", key)
+		}
+	}
+	u.Fragment = ""
+	return u.String(), fronting, fingerprint, nil
+}
+
+// newUpstream sets up the transports and the tunnel pools of a server
+func (c *Client) newUpstream(cfg UpstreamConfig, tlsConfig *tls.Config) (*upstream, error) {
+	u := &upstream{
+		endpoint:   strings.SplitN(cfg.Endpoint, "#", 2)[0],
+		transports: make(map[PathType]Transport),
+	}
+	endpoints := map[PathType]string{TwoWay: cfg.Endpoint}
+	if cfg.Upload != "" || cfg.Download != "" || c.cfg.DownloadStripes > 1 || c.cfg.UploadStripes > 1 {
+		u.split = true
+		endpoints = map[PathType]string{Upload: cfg.Endpoint, Download: cfg.Endpoint}
+		if cfg.Upload != "" {
+			endpoints[Upload] = cfg.Upload
+		}
+		if cfg.Download != "" {
+			endpoints[Download] = cfg.Download
+		}
+	}
+	for pathType, endpoint := range endpoints {
+		transport, err := c.newPathTransport(endpoint, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		u.transports[pathType] = transport
+	}
+
+	switch {
+	case c.cfg.MuxConns > 0:
+		u.muxPools = make(map[PathType]*MuxPool)
+		for pathType, transport := range u.transports {
+			pathType, transport := pathType, transport
+			u.muxPools[pathType] = NewMuxPool(c.cfg.MuxConns, func() (net.Conn, error) {
+				return c.dialMuxTunnel(transport, pathType)
+			})
+		}
+	case c.cfg.IdleConns > 0:
+		u.idlePools = make(map[PathType]*IdlePool)
+		for pathType, transport := range u.transports {
+			pathType, transport := pathType, transport
+			u.idlePools[pathType] = NewIdlePool(c.cfg.IdleConns, c.cfg.IdleMaxAge, c.cfg.IdlePing, c.auth, func() (net.Conn, error) {
+				return transport.Dial(pathType)
+			})
+		}
+	}
+	return u, nil
+}
+
+// newPathTransport sets up the transport of an endpoint, with its own
+// fronting settings and fingerprint
+func (c *Client) newPathTransport(endpoint string, tlsConfig *tls.Config) (Transport, error) {
+	endpoint, fronting, fpName, err := parseEndpoint(endpoint, c.cfg.Fronting, c.cfg.Fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint, err := NewFingerprint(fpName, c.cfg.FingerprintFile)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := NewDialSettings(endpoint, fronting, tlsConfig, fingerprint, c.auth)
+	if err != nil {
+		return nil, err
+	}
+	if len(fronting.Relays) > 0 {
+		if settings.relays, err = NewRelayPool(endpoint, fronting.Relays, c.cfg.Relays); err != nil {
+			return nil, err
+		}
+	}
+	transport, err := newTransport(settings)
+	if err != nil {
+		return nil, err
+	}
+	var wrappers []TunnelWrapper
+	if c.cfg.Encryption != "" {
+		encrypt, err := encryptTunnels(c.cfg.Encryption, c.cfg.Secret)
+		if err != nil {
+			return nil, err
+		}
+		wrappers = append(wrappers, encrypt)
+	}
+	return wrapTransport(transport, wrappers...), nil
+}
+
+// dialMuxTunnel opens a tunnel and turns it into a multiplexed tunnel
+func (c *Client) dialMuxTunnel(transport Transport, pathType PathType) (net.Conn, error) {
+	conn, err := transport.Dial(pathType)
+	if err != nil {
+		return nil, err
+	}
+	err = writePathReq(conn, &PathReq{
+		Id:    NewUUID(),
+		PType: Multiplex,
+	}, c.auth)
+	if err == nil {
+		err = readHandshakeReply(conn)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// encryptTunnels returns the wrapper adding the inner encryption layer to tunnels
+func encryptTunnels(cipher, secret string) (TunnelWrapper, error) {
+	if secret == "" {
+		// without it anyone terminating TLS could negotiate the keys
+		return nil, errors.New("encryption needs a pre-shared key")
+	}
+	cipherID, err := aead.CipherByName(cipher)
+	if err != nil {
+		return nil, err
+	}
+	return func(conn net.Conn) (net.Conn, error) {
+		return aead.Client(conn, cipherID, []byte(secret))
+	}, nil
+}
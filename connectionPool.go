@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	"io"
-	"net"
 )
 
 type ConnectionPool struct {
@@ -19,11 +18,6 @@ type Request struct {
 	closeSignal chan error
 }
 
-type ServerConnection struct {
-	id   string // A unique id to identify a connection
-	conn net.Conn
-}
-
 func NewConnectionPool() *ConnectionPool {
 	return &ConnectionPool{
 		NewCache(0),
@@ -43,24 +37,29 @@ func (cp *ConnectionPool) NewConnection(t NetworkType, closeSignal chan error, c
 	return cID
 }
 
-func (cp *ConnectionPool) NewSrvConnection(id string, conn net.Conn) {
-	cp.cache.Set(id, ServerConnection{
-		id,
-		conn,
-	})
-}
+// pollSessionKey prefixes the ids of polling sessions, so they can't collide with tunnel ids
+const pollSessionKey = "poll:"
 
-func (cp *ConnectionPool) GetConnection(cID string) (Request, bool) {
-	c, found := cp.cache.Get(cID)
-	return c.(Request), found
+// NewPollSession adds a polling session, it fails if the id is taken already
+func (cp *ConnectionPool) NewPollSession(id string, sess *pollSession) error {
+	return cp.cache.Add(pollSessionKey+id, sess)
 }
 
-func (cp *ConnectionPool) GetSrvConnection(cID string) (net.Conn, bool) {
-	c, found := cp.cache.Get(cID)
+func (cp *ConnectionPool) GetPollSession(id string) (*pollSession, bool) {
+	s, found := cp.cache.Get(pollSessionKey + id)
 	if !found {
 		return nil, false
 	}
-	return c.(ServerConnection).conn, found
+	return s.(*pollSession), true
+}
+
+func (cp *ConnectionPool) RmPollSession(id string) {
+	cp.cache.Delete(pollSessionKey + id)
+}
+
+func (cp *ConnectionPool) GetConnection(cID string) (Request, bool) {
+	c, found := cp.cache.Get(cID)
+	return c.(Request), found
 }
 
 func (cp *ConnectionPool) RmConnection(cID string) {
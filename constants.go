@@ -1,6 +1,9 @@
 package main
 
-import "egg/bufferpool"
+import (
+	"egg/bufferpool"
+	"time"
+)
 
 type NetworkType int32
 
@@ -15,10 +18,22 @@ const (
 	Upload   PathType = 0
 	Download PathType = 1
 	TwoWay   PathType = 2
+	// Multiplex turns the tunnel into a mux session carrying many TwoWay paths
+	Multiplex PathType = 3
+	// Ping keeps an idle tunnel alive until it's used for one of the other path types
+	Ping PathType = 4
 )
 
+// HandshakeTimeout is how long the server waits for a tunnel handshake
+const HandshakeTimeout = 10 * time.Second
+
+// TunnelIdleTimeout is how long the server keeps a tunnel open after a ping
+// until the next handshake
+const TunnelIdleTimeout = 2 * time.Minute
+
+// DialTimeout is how long the server tries to connect to a destination
+const DialTimeout = 10 * time.Second
+
 var (
-	RelayAddress          string = ""
-	RelayAddressToReplace string = ""
-	BufferPool            bufferpool.BufPool
+	BufferPool bufferpool.BufPool
 )
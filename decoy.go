@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DecoyOptions controls what the server answers to everything that isn't a
+// tunnel, so the host looks like an ordinary website to probers
+type DecoyOptions struct {
+	// Dir is a directory of static files to serve
+	Dir string
+	// ProxyURL is a real website to reverse proxy to, it overrides Dir
+	ProxyURL string
+}
+
+// decoyMaxAge is the Cache-Control max-age of static files
+const decoyMaxAge = time.Hour
+
+// newDecoyHandler returns the handler of non-tunnel requests, without a
+// directory or backend every request is answered with a plain 404
+func newDecoyHandler(opts DecoyOptions) (http.Handler, error) {
+	switch {
+	case opts.ProxyURL != "":
+		target, err := url.Parse(opts.ProxyURL)
+		if err != nil || target.Scheme == "" || target.Host == "" {
+			return nil, fmt.Errorf("invalid decoy url %q", opts.ProxyURL)
+		}
+		return newReverseProxy(target), nil
+	case opts.Dir != "":
+		info, err := os.Stat(opts.Dir)
+		if err != nil {
+			return nil, fmt.Errorf("unable to serve decoy directory: %v", err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("decoy %s is not a directory", opts.Dir)
+		}
+		return &staticSite{root: opts.Dir}, nil
+	default:
+		return http.NotFoundHandler(), nil
+	}
+}
+
+// newReverseProxy returns a handler forwarding requests to the website at target
+func newReverseProxy(target *url.URL) http.Handler {
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		// the backend expects its own host name, not the tunnel's
+		r.Host = target.Host
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		fmt.Println("backend error:", err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	return proxy
+}
+
+// staticSite serves files of a directory the way a typical web server does:
+// index.html for directories, 404.html for missing files and no listings
+type staticSite struct {
+	root string
+}
+
+func (s *staticSite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") {
+		name = path.Join(name, "index.html")
+	}
+	f, info, err := s.open(name)
+	if err == nil && info.IsDir() {
+		f.Close()
+		// like other web servers, directories are redirected to their trailing slash
+		target := r.URL.Path + "/"
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+	if err != nil {
+		s.notFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(decoyMaxAge.Seconds())))
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().Unix(), info.Size()))
+	// ServeContent picks the content type and handles conditional and range requests
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+func (s *staticSite) open(name string) (*os.File, os.FileInfo, error) {
+	f, err := os.Open(filepath.Join(s.root, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+// notFound answers with the site's 404.html, or a plain 404 if it has none
+func (s *staticSite) notFound(w http.ResponseWriter, r *http.Request) {
+	f, info, err := s.open("/404.html")
+	if err != nil || info.IsDir() {
+		if f != nil {
+			f.Close()
+		}
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	if r.Method != http.MethodHead {
+		_, _ = io.Copy(w, f)
+	}
+}
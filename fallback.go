@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// newFallbackHandler returns the handler of requests to the tunnel path that
+// aren't valid or authenticated tunnel upgrades. target is an http(s) url to
+// reverse proxy to, a tcp://host:port to splice the raw connection with, or
+// empty to answer like the decoy does
+func newFallbackHandler(target string, decoy http.Handler) (http.Handler, error) {
+	if target == "" {
+		return decoy, nil
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid fallback %q", target)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return newReverseProxy(u), nil
+	case "tcp":
+		return &tcpSplice{addr: u.Host}, nil
+	default:
+		return nil, fmt.Errorf("invalid fallback %q, it should start with http, https or tcp", target)
+	}
+}
+
+// tcpSplice hands the client's connection over to a backend, the request is
+// written to the backend as it was received and everything after it is
+// relayed untouched in both directions
+type tcpSplice struct {
+	addr string
+}
+
+func (ts *tcpSplice) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	backend, err := net.DialTimeout("tcp", ts.addr, DialTimeout)
+	if err != nil {
+		fmt.Println("backend error:", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer backend.Close()
+
+	// the request and its body are forwarded before the connection is taken over
+	if err := r.Write(backend); err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		// HTTP/2 streams can't be taken over, the backend answers this request only
+		ts.forward(w, r, backend)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// bytes the http server has read ahead belong to the backend too
+	if n := brw.Reader.Buffered(); n > 0 {
+		buffered, _ := brw.Reader.Peek(n)
+		if _, err := backend.Write(buffered); err != nil {
+			return
+		}
+	}
+
+	errCh := make(chan error, 2)
+	go func() { errCh <- Copy(conn, backend) }()
+	go func() { errCh <- Copy(backend, conn) }()
+	<-errCh
+}
+
+// forward relays the backend's response to the request that's already been written to it
+func (ts *tcpSplice) forward(w http.ResponseWriter, r *http.Request, backend net.Conn) {
+	resp, err := http.ReadResponse(bufio.NewReader(backend), r)
+	if err != nil {
+		fmt.Println("backend error:", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for name, values := range resp.Header {
+		switch name {
+		case "Connection", "Keep-Alive", "Transfer-Encoding", "Upgrade":
+			// connection specific headers aren't allowed in HTTP/2
+			continue
+		}
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	_ = Copy(resp.Body, w)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	tls "github.com/refraction-networking/utls"
+	"net"
+	"os"
+)
+
+// fingerprints maps --fingerprint names to uTLS ClientHello presets
+var fingerprints = map[string]tls.ClientHelloID{
+	"android":           tls.HelloAndroid_11_OkHttp,
+	"chrome":            tls.HelloChrome_Auto,
+	"firefox":           tls.HelloFirefox_Auto,
+	"safari":            tls.HelloSafari_Auto,
+	"ios":               tls.HelloIOS_Auto,
+	"edge":              tls.HelloEdge_Auto,
+	"randomized":        tls.HelloRandomized,
+	"randomized-noalpn": tls.HelloRandomizedNoALPN,
+}
+
+// Fingerprint shapes the ClientHello of the client's TLS connections
+type Fingerprint struct {
+	id tls.ClientHelloID
+	// custom holds a ClientHello spec in the uTLS JSON format, it's parsed
+	// again for every connection because specs can't be shared between them
+	custom []byte
+}
+
+// NewFingerprint returns the preset called name, or the custom spec stored in
+// file when it isn't empty
+func NewFingerprint(name string, file string) (*Fingerprint, error) {
+	if file != "" {
+		custom, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read fingerprint: %v", err)
+		}
+		fp := &Fingerprint{custom: custom}
+		if _, err := fp.spec(nil); err != nil {
+			return nil, fmt.Errorf("invalid fingerprint %s: %v", file, err)
+		}
+		return fp, nil
+	}
+
+	id, ok := fingerprints[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown fingerprint %q", name)
+	}
+	return &Fingerprint{id: id}, nil
+}
+
+// spec returns a fresh ClientHello spec, when alpn isn't nil it replaces the
+// protocols of the ALPN extension while keeping the extension at its position
+func (fp *Fingerprint) spec(alpn []string) (*tls.ClientHelloSpec, error) {
+	var spec tls.ClientHelloSpec
+	if fp.custom != nil {
+		var u tls.ClientHelloSpecJSONUnmarshaler
+		if err := json.Unmarshal(fp.custom, &u); err != nil {
+			return nil, err
+		}
+		spec = u.ClientHelloSpec()
+	} else {
+		var err error
+		if spec, err = tls.UTLSIdToSpec(fp.id); err != nil {
+			return nil, err
+		}
+	}
+
+	if alpn != nil {
+		for _, ext := range spec.Extensions {
+			if alpnExt, ok := ext.(*tls.ALPNExtension); ok {
+				alpnExt.AlpnProtocols = alpn
+			}
+		}
+	}
+	return &spec, nil
+}
+
+// Client returns a uTLS client connection over conn whose ClientHello
+// advertises only the alpn protocols
+func (fp *Fingerprint) Client(conn net.Conn, config *tls.Config, alpn []string) (*tls.UConn, error) {
+	spec, err := fp.spec(alpn)
+	if err != nil {
+		return nil, err
+	}
+	uconn := tls.UClient(conn, config, tls.HelloCustom)
+	if err := uconn.ApplyPreset(spec); err != nil {
+		return nil, err
+	}
+	return uconn, nil
+}
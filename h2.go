@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"egg/h2conn"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// h2ALPN is what the HTTP/2 dialer advertises, like browsers do. the server
+// prefers h2, and anything else fails the tunnel
+var h2ALPN = []string{"h2", "http/1.1"}
+
+// H2Dialer opens tunnels as full-duplex HTTP/2 streams: a POST request whose
+// body carries the upload and whose response body carries the download.
+// Tunnels share HTTP/2 connections, h2s:// endpoints use TLS and h2://
+// endpoints cleartext HTTP/2 with prior knowledge
+type H2Dialer struct {
+	*DialSettings
+
+	transport *http2.Transport
+}
+
+func NewH2Dialer(s *DialSettings) *H2Dialer {
+	d := &H2Dialer{DialSettings: s}
+	d.transport = &http2.Transport{
+		// cleartext endpoints are dialed without TLS
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(ctx, DialTimeout)
+			defer cancel()
+			if u, _ := url.Parse(d.endpoint); u != nil && u.Scheme == "h2" {
+				return d.dialTCP(ctx, network, addr)
+			}
+			conn, err := d.dialTLS(ctx, network, addr, h2ALPN)
+			if err != nil {
+				return nil, err
+			}
+			if proto := conn.ConnectionState().NegotiatedProtocol; proto != http2.NextProtoTLS {
+				conn.Close()
+				return nil, fmt.Errorf("h2: server negotiated %q instead of h2", proto)
+			}
+			return conn, nil
+		},
+		ReadIdleTimeout: 30 * time.Second,
+	}
+	return d
+}
+
+// Dial opens a tunnel stream, it returns once the server has answered the request
+func (d *H2Dialer) Dial(pathType PathType) (net.Conn, error) {
+	u, err := url.Parse(d.url())
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "h2" {
+		u.Scheme = "http"
+	} else {
+		u.Scheme = "https"
+	}
+	header, err := d.requestHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	body, bodyWriter := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), body)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header = header.Clone()
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+		req.Header.Del("Host")
+	}
+
+	// the timer only bounds the wait for the response headers
+	timer := time.AfterFunc(HandshakeTimeout, cancel)
+	resp, err := d.transport.RoundTrip(req)
+	if !timer.Stop() && err == nil {
+		resp.Body.Close()
+		err = context.DeadlineExceeded
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("h2: unexpected status %s", resp.Status)
+	}
+	return h2conn.Client(bodyWriter, resp, cancel), nil
+}
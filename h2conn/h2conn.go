@@ -0,0 +1,164 @@
+package h2conn
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// an adapter for representing a full-duplex HTTP/2 stream, ie. a request body
+// and the body of its response, as a net.Conn
+// some caveats apply: an expired deadline closes the whole connection instead
+// of failing only the pending operation, and addresses are those of the
+// underlying HTTP/2 connection if they're known at all
+
+var ErrClosed = errors.New("h2conn: use of closed connection")
+
+type Conn struct {
+	reader  io.ReadCloser
+	writer  io.Writer
+	flusher http.Flusher
+	// onClose releases the stream, ex. by cancelling its request
+	onClose func()
+
+	local  net.Addr
+	remote net.Addr
+
+	writeMutex sync.Mutex
+	closed     bool
+	closeOnce  sync.Once
+
+	timerMutex sync.Mutex
+	readTimer  *time.Timer
+	writeTimer *time.Timer
+}
+
+// Client wraps the request body writer and the response body of a client
+// stream, onClose is called once the connection is closed
+func Client(body io.WriteCloser, resp *http.Response, onClose func()) *Conn {
+	return &Conn{
+		reader:  resp.Body,
+		writer:  body,
+		onClose: onClose,
+		local:   addr{},
+		remote:  addr{},
+	}
+}
+
+// Server wraps the request body and the response writer of a server stream,
+// every write is flushed so that it's sent right away
+func Server(w http.ResponseWriter, r *http.Request) *Conn {
+	flusher, _ := w.(http.Flusher)
+	remote := net.Addr(addr{})
+	if a, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		remote = a
+	}
+	local := net.Addr(addr{})
+	if a, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		local = a
+	}
+	return &Conn{
+		reader:  r.Body,
+		writer:  w,
+		flusher: flusher,
+		local:   local,
+		remote:  remote,
+	}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if c.closed {
+		return 0, ErrClosed
+	}
+	n, err := c.writer.Write(b)
+	if err == nil && c.flusher != nil {
+		c.flusher.Flush()
+	}
+	return n, err
+}
+
+// Close closes both directions of the stream, it waits for a pending write
+// so that nothing is written to the stream after Close returns
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.reader.Close()
+		if closer, ok := c.writer.(io.Closer); ok {
+			closer.Close()
+		}
+		if c.onClose != nil {
+			c.onClose()
+		}
+
+		c.writeMutex.Lock()
+		c.closed = true
+		c.writeMutex.Unlock()
+
+		c.timerMutex.Lock()
+		stopTimer(c.readTimer)
+		stopTimer(c.writeTimer)
+		c.timerMutex.Unlock()
+	})
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.timerMutex.Lock()
+	defer c.timerMutex.Unlock()
+	c.readTimer = c.resetTimer(c.readTimer, t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.timerMutex.Lock()
+	defer c.timerMutex.Unlock()
+	c.writeTimer = c.resetTimer(c.writeTimer, t)
+	return nil
+}
+
+// resetTimer replaces timer with one closing the connection at t, a zero t
+// clears the deadline
+func (c *Conn) resetTimer(timer *time.Timer, t time.Time) *time.Timer {
+	stopTimer(timer)
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), func() { c.Close() })
+}
+
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+// addr is the address of a stream whose endpoints aren't known
+type addr struct{}
+
+func (addr) Network() string { return "h2" }
+func (addr) String() string  { return "h2" }
@@ -11,6 +11,9 @@ import (
 type Handle struct {
 	cp   *ConnectionPool
 	fifo *FIFO
+	// optimistic replies success before the tunnel is established, otherwise
+	// the tunnel replies once the server reports the outcome of its dial
+	optimistic bool
 }
 
 type SocksReq struct {
@@ -24,16 +27,21 @@ type PathReq struct {
 	Dest  string
 	Net   NetworkType
 	PType PathType
+	// Stripe is the index of the path among the Stripes paths of its
+	// direction, Stripes is 0 or 1 when the direction isn't striped
+	Stripe  int
+	Stripes int
 }
 
 func (c *Handle) handleTCPConnect(ctx context.Context, writer io.Writer, request *socks5.Request) error {
 	fmt.Println(request.RawDestAddr)
-	closeSignal := make(chan error)
+	closeSignal := make(chan error, 1)
 	id := c.cp.NewConnection(TCP, closeSignal, ctx, writer, request.Reader)
 
-	// it informs the socks client that connection to remote host was successfully established
-	if err := socks5.SendReply(writer, statute.RepSuccess, nil); err != nil {
-		return fmt.Errorf("failed to send reply, %v", err)
+	if c.optimistic {
+		if err := socks5.SendReply(writer, statute.RepSuccess, nil); err != nil {
+			return fmt.Errorf("failed to send reply, %v", err)
+		}
 	}
 
 	err := c.fifo.Enqueue(&SocksReq{
@@ -52,12 +60,13 @@ func (c *Handle) handleTCPConnect(ctx context.Context, writer io.Writer, request
 
 func (c *Handle) handleUDPAssociate(ctx context.Context, writer io.Writer, request *socks5.Request) error {
 	fmt.Println(request.RawDestAddr)
-	closeSignal := make(chan error)
+	closeSignal := make(chan error, 1)
 	id := c.cp.NewConnection(UDP, closeSignal, ctx, writer, request.Reader)
 
-	// it informs the socks client that connection to remote host was successfully established
-	if err := socks5.SendReply(writer, statute.RepSuccess, nil); err != nil {
-		return fmt.Errorf("failed to send reply, %v", err)
+	if c.optimistic {
+		if err := socks5.SendReply(writer, statute.RepSuccess, nil); err != nil {
+			return fmt.Errorf("failed to send reply, %v", err)
+		}
 	}
 
 	err := c.fifo.Enqueue(&SocksReq{
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"egg/socks5/statute"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// Every tunnel starts with a handshake request sent by the client, it's formed as follows:
+//
+// +-------+-----+-----+-------+-------+--------+----------+------+----------+----------+
+// | MAGIC | VER | CMD | PTYPE | FLAGS | ID.LEN |    ID    | ATYP | DST.ADDR | DST.PORT |
+// +-------+-----+-----+-------+-------+--------+----------+------+----------+----------+
+// |   2   |  1  |  1  |   1   |   1   |   1    | Variable |  1   | Variable |    2     |
+// +-------+-----+-----+-------+-------+--------+----------+------+----------+----------+
+//
+//   - MAGIC is always X'45 47' ("EG")
+//   - VER is the protocol version, currently X'01'
+//   - CMD is one of CmdConnect (tcp), CmdAssociate (udp), CmdMux or CmdPing, a CmdMux
+//     tunnel carries a multiplexed session whose streams start with their own handshake,
+//     and a CmdPing request keeps an idle tunnel alive, the server replies to it and
+//     waits for the next handshake on the same tunnel
+//   - PTYPE is the path type, X'00' upload, X'01' download or X'02' two way
+//   - FLAGS is a bit field, bits unknown to the receiver are rejected, FlagAuth
+//     means the request is followed by an auth block (see auth.go), FlagStripe
+//     means DST.PORT is followed by the 1 byte STRIPE and STRIPES of the path
+//   - ID is the connection id, 1 to MaxIdLength bytes, upload and download paths of
+//     the same connection share it
+//   - ATYP, DST.ADDR and DST.PORT are encoded as in SOCKS5 (RFC 1928), a domain is
+//     prefixed with its 1 byte length and the port is big endian
+//   - STRIPE is the index of an upload or download path among the STRIPES paths
+//     of its direction, the connection's data is striped over them (see stripe/)
+//
+// The server answers every handshake with a reply:
+//
+// +-------+-----+--------+
+// | MAGIC | VER | STATUS |
+// +-------+-----+--------+
+// |   2   |  1  |   1    |
+// +-------+-----+--------+
+//
+// VER is the version the server speaks, and data starts flowing only after a
+// StatusOK reply. On any other status the server closes the tunnel.
+const (
+	HandshakeVersion byte = 0x01
+	MaxIdLength           = 64
+	MaxStripes            = 16
+)
+
+var handshakeMagic = []byte{0x45, 0x47}
+
+// handshake commands
+const (
+	CmdConnect   byte = 0x01
+	CmdAssociate byte = 0x03
+	CmdMux       byte = 0x04
+	CmdPing      byte = 0x05
+)
+
+// handshake reply status
+const (
+	StatusOK byte = iota
+	StatusServerFailure
+	StatusVersionMismatch
+	StatusBadRequest
+	// the statuses below report the outcome of dialing the destination
+	StatusConnectionRefused
+	StatusHostUnreachable
+	StatusNetworkUnreachable
+	StatusTimeout
+	// the destination is denied by the server's rules, see DestRules
+	StatusRuleBlocked
+	StatusUnauthorized
+	// the other path of a split connection didn't arrive in time
+	StatusNoPartner
+)
+
+// handshake flags
+const (
+	FlagAuth   byte = 0x01
+	FlagStripe byte = 0x02
+)
+
+// knownFlags holds every handshake flag bit understood by this version
+const knownFlags = FlagAuth | FlagStripe
+
+const handshakeHeaderSize = 7
+
+var (
+	ErrBadMagic = errors.New("handshake: bad magic, peer does not speak the egg protocol")
+)
+
+// HandshakeError is returned when a handshake is rejected, Status is the
+// reply status sent back or received from the peer
+type HandshakeError struct {
+	Status  byte
+	Version byte
+	msg     string
+}
+
+func (e *HandshakeError) Error() string {
+	return e.msg
+}
+
+func statusText(status byte) string {
+	switch status {
+	case StatusOK:
+		return "ok"
+	case StatusServerFailure:
+		return "server failure"
+	case StatusVersionMismatch:
+		return "protocol version mismatch"
+	case StatusBadRequest:
+		return "bad request"
+	case StatusConnectionRefused:
+		return "connection refused"
+	case StatusHostUnreachable:
+		return "host unreachable"
+	case StatusNetworkUnreachable:
+		return "network unreachable"
+	case StatusTimeout:
+		return "timeout"
+	case StatusRuleBlocked:
+		return "blocked by rules"
+	case StatusUnauthorized:
+		return "unauthorized"
+	case StatusNoPartner:
+		return "the other path of the connection never arrived"
+	default:
+		return "unknown status " + strconv.Itoa(int(status))
+	}
+}
+
+// writePathReq sends the handshake request of a tunnel, it's signed when auth isn't nil
+func writePathReq(w io.Writer, pathReq *PathReq, auth *PSKAuth) error {
+	if len(pathReq.Id) == 0 || len(pathReq.Id) > MaxIdLength {
+		return fmt.Errorf("handshake: invalid id length %d", len(pathReq.Id))
+	}
+
+	cmd, pType, dest := CmdConnect, pathReq.PType, pathReq.Dest
+	if pathReq.PType == Multiplex {
+		// a multiplexed tunnel has no destination of its own
+		cmd, pType, dest = CmdMux, TwoWay, "0.0.0.0:0"
+	} else if pathReq.PType == Ping {
+		cmd, pType, dest = CmdPing, TwoWay, "0.0.0.0:0"
+	} else if pathReq.Net == UDP {
+		cmd = CmdAssociate
+	}
+
+	addr, err := encodeAddr(dest)
+	if err != nil {
+		return err
+	}
+
+	var flags byte
+	if auth != nil {
+		flags |= FlagAuth
+	}
+	if pathReq.Stripes > 1 {
+		if pathReq.PType != Upload && pathReq.PType != Download {
+			return fmt.Errorf("handshake: path type %d can't be striped", pathReq.PType)
+		}
+		if pathReq.Stripes > MaxStripes || pathReq.Stripe < 0 || pathReq.Stripe >= pathReq.Stripes {
+			return fmt.Errorf("handshake: invalid stripe %d of %d", pathReq.Stripe, pathReq.Stripes)
+		}
+		flags |= FlagStripe
+		addr = append(addr, byte(pathReq.Stripe), byte(pathReq.Stripes))
+	}
+
+	b := make([]byte, 0, handshakeHeaderSize+len(pathReq.Id)+len(addr)+authBlockSize)
+	b = append(b, handshakeMagic...)
+	b = append(b, HandshakeVersion, cmd, byte(pType), flags, byte(len(pathReq.Id)))
+	b = append(b, pathReq.Id...)
+	b = append(b, addr...)
+	if auth != nil {
+		block, err := auth.sign(b)
+		if err != nil {
+			return err
+		}
+		b = append(b, block...)
+	}
+
+	_, err = w.Write(b)
+	return err
+}
+
+// readPathReq reads and validates the handshake request of a tunnel, when auth
+// isn't nil only requests signed with its key are accepted
+func readPathReq(r io.Reader, auth *PSKAuth) (*PathReq, error) {
+	// everything up to the auth block is recorded to verify its mac
+	var msg bytes.Buffer
+	tr := io.TeeReader(r, &msg)
+
+	header := make([]byte, handshakeHeaderSize)
+	if _, err := io.ReadFull(tr, header); err != nil {
+		return nil, err
+	}
+	if header[0] != handshakeMagic[0] || header[1] != handshakeMagic[1] {
+		return nil, &HandshakeError{StatusBadRequest, header[2], ErrBadMagic.Error()}
+	}
+	if header[2] != HandshakeVersion {
+		return nil, &HandshakeError{StatusVersionMismatch, header[2],
+			fmt.Sprintf("handshake: client speaks version %d, server speaks version %d", header[2], HandshakeVersion)}
+	}
+
+	q := &PathReq{}
+	cmd, pType, flags, idLen := header[3], PathType(header[4]), header[5], int(header[6])
+	if flags&^knownFlags != 0 {
+		return nil, &HandshakeError{StatusBadRequest, header[2], fmt.Sprintf("handshake: unknown flags %#x", flags)}
+	}
+	if pType != Upload && pType != Download && pType != TwoWay {
+		return nil, &HandshakeError{StatusBadRequest, header[2], fmt.Sprintf("handshake: unknown path type %d", pType)}
+	}
+	switch cmd {
+	case CmdConnect:
+		q.Net, q.PType = TCP, pType
+	case CmdAssociate:
+		q.Net, q.PType = UDP, pType
+	case CmdMux:
+		q.Net, q.PType = TCP, Multiplex
+	case CmdPing:
+		q.Net, q.PType = TCP, Ping
+	default:
+		return nil, &HandshakeError{StatusBadRequest, header[2], fmt.Sprintf("handshake: unknown command %#x", cmd)}
+	}
+	if idLen == 0 || idLen > MaxIdLength {
+		return nil, &HandshakeError{StatusBadRequest, header[2], fmt.Sprintf("handshake: invalid id length %d", idLen)}
+	}
+
+	id := make([]byte, idLen)
+	if _, err := io.ReadFull(tr, id); err != nil {
+		return nil, err
+	}
+	q.Id = string(id)
+
+	dest, err := decodeAddr(tr)
+	if err != nil {
+		return nil, err
+	}
+	q.Dest = dest
+
+	q.Stripes = 1
+	if flags&FlagStripe != 0 {
+		stripe := make([]byte, 2)
+		if _, err := io.ReadFull(tr, stripe); err != nil {
+			return nil, err
+		}
+		q.Stripe, q.Stripes = int(stripe[0]), int(stripe[1])
+		if q.PType != Upload && q.PType != Download {
+			return nil, &HandshakeError{StatusBadRequest, header[2], fmt.Sprintf("handshake: path type %d can't be striped", q.PType)}
+		}
+		if q.Stripes < 2 || q.Stripes > MaxStripes || q.Stripe >= q.Stripes {
+			return nil, &HandshakeError{StatusBadRequest, header[2], fmt.Sprintf("handshake: invalid stripe %d of %d", q.Stripe, q.Stripes)}
+		}
+	}
+
+	if flags&FlagAuth == 0 {
+		if auth != nil {
+			return nil, &HandshakeError{StatusUnauthorized, header[2], ErrAuthRequired.Error()}
+		}
+		return q, nil
+	}
+
+	block := make([]byte, authBlockSize)
+	if _, err := io.ReadFull(r, block); err != nil {
+		return nil, err
+	}
+	if auth != nil {
+		if err := auth.verify(msg.Bytes(), block); err != nil {
+			return nil, &HandshakeError{StatusUnauthorized, header[2], err.Error()}
+		}
+	}
+	return q, nil
+}
+
+// writeHandshakeReply sends the reply of a handshake
+func writeHandshakeReply(w io.Writer, status byte) error {
+	b := make([]byte, 0, 4)
+	b = append(b, handshakeMagic...)
+	b = append(b, HandshakeVersion, status)
+	_, err := w.Write(b)
+	return err
+}
+
+// readHandshakeReply reads the reply of a handshake, it returns a
+// HandshakeError if the server didn't accept the tunnel
+func readHandshakeReply(r io.Reader) error {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return fmt.Errorf("handshake: failed to read reply, %v", err)
+	}
+	if b[0] != handshakeMagic[0] || b[1] != handshakeMagic[1] {
+		return ErrBadMagic
+	}
+	if b[3] == StatusOK {
+		return nil
+	}
+	if b[3] == StatusVersionMismatch || b[2] != HandshakeVersion {
+		return &HandshakeError{b[3], b[2],
+			fmt.Sprintf("handshake: server speaks version %d, client speaks version %d", b[2], HandshakeVersion)}
+	}
+	return &HandshakeError{b[3], b[2], "handshake: server replied " + statusText(b[3])}
+}
+
+// dialStatus maps the error of dialing a destination to a reply status
+func dialStatus(err error) byte {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, ErrRuleBlocked):
+		return StatusRuleBlocked
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return StatusConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return StatusNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return StatusHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return StatusTimeout
+	default:
+		return StatusServerFailure
+	}
+}
+
+// socksReply maps a handshake reply status to a socks reply
+func socksReply(status byte) uint8 {
+	switch status {
+	case StatusOK:
+		return statute.RepSuccess
+	case StatusConnectionRefused:
+		return statute.RepConnectionRefused
+	case StatusHostUnreachable:
+		return statute.RepHostUnreachable
+	case StatusNetworkUnreachable:
+		return statute.RepNetworkUnreachable
+	case StatusTimeout:
+		return statute.RepTTLExpired
+	case StatusRuleBlocked:
+		return statute.RepRuleFailure
+	default:
+		return statute.RepServerFailure
+	}
+}
+
+// encodeAddr encodes host:port as SOCKS5 ATYP, DST.ADDR and DST.PORT
+func encodeAddr(addr string) ([]byte, error) {
+	as, err := statute.ParseAddrSpec(addr)
+	if err != nil {
+		return nil, fmt.Errorf("handshake: invalid address %q, %v", addr, err)
+	}
+	if as.Port < 0 || as.Port > 0xffff {
+		return nil, fmt.Errorf("handshake: invalid port %d", as.Port)
+	}
+
+	var b []byte
+	switch as.AddrType {
+	case statute.ATYPIPv4:
+		b = append([]byte{statute.ATYPIPv4}, as.IP.To4()...)
+	case statute.ATYPIPv6:
+		b = append([]byte{statute.ATYPIPv6}, as.IP.To16()...)
+	default:
+		if len(as.FQDN) == 0 || len(as.FQDN) > 0xff {
+			return nil, fmt.Errorf("handshake: invalid domain length %d", len(as.FQDN))
+		}
+		b = append([]byte{statute.ATYPDomain, byte(len(as.FQDN))}, as.FQDN...)
+	}
+	return append(b, byte(as.Port>>8), byte(as.Port)), nil
+}
+
+// decodeAddr reads SOCKS5 ATYP, DST.ADDR and DST.PORT and returns them as host:port
+func decodeAddr(r io.Reader) (string, error) {
+	tmp := []byte{0}
+	if _, err := io.ReadFull(r, tmp); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch tmp[0] {
+	case statute.ATYPIPv4, statute.ATYPIPv6:
+		size := net.IPv4len
+		if tmp[0] == statute.ATYPIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case statute.ATYPDomain:
+		if _, err := io.ReadFull(r, tmp); err != nil {
+			return "", err
+		}
+		if tmp[0] == 0 {
+			return "", &HandshakeError{StatusBadRequest, HandshakeVersion, "handshake: empty domain"}
+		}
+		domain := make([]byte, tmp[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", &HandshakeError{StatusBadRequest, HandshakeVersion, statute.ErrUnrecognizedAddrType.Error()}
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func encodePathReq(t *testing.T, q *PathReq, auth *PSKAuth) []byte {
+	var b bytes.Buffer
+	if err := writePathReq(&b, q, auth); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// handshakeStatus returns the status of a HandshakeError, or -1 for other errors
+func handshakeStatus(err error) int {
+	var hsErr *HandshakeError
+	if errors.As(err, &hsErr) {
+		return int(hsErr.Status)
+	}
+	return -1
+}
+
+func TestPathReqRoundTrip(t *testing.T) {
+	requests := []*PathReq{
+		{Id: "a", Dest: "1.2.3.4:80", Net: TCP, PType: TwoWay, Stripes: 1},
+		{Id: "upload", Dest: "[2001:db8::1]:443", Net: TCP, PType: Upload, Stripes: 1},
+		{Id: "download", Dest: "example.com:8080", Net: TCP, PType: Download, Stripes: 1},
+		{Id: "udp", Dest: "8.8.8.8:53", Net: UDP, PType: TwoWay, Stripes: 1},
+		{Id: "mux", Dest: "0.0.0.0:0", Net: TCP, PType: Multiplex, Stripes: 1},
+		{Id: "ping", Dest: "0.0.0.0:0", Net: TCP, PType: Ping, Stripes: 1},
+		{Id: "striped", Dest: "example.com:80", Net: TCP, PType: Download, Stripe: 3, Stripes: MaxStripes},
+		{Id: string(bytes.Repeat([]byte("x"), MaxIdLength)), Dest: "1.2.3.4:65535", Net: TCP, PType: TwoWay, Stripes: 1},
+	}
+	for _, signed := range []bool{false, true} {
+		for _, q := range requests {
+			var auth *PSKAuth
+			if signed {
+				auth = NewPSKAuth("secret")
+			}
+			r := bytes.NewReader(encodePathReq(t, q, auth))
+			got, err := readPathReq(r, auth)
+			if err != nil {
+				t.Fatalf("%s (signed %v): %v", q.Id, signed, err)
+			}
+			if !reflect.DeepEqual(got, q) {
+				t.Fatalf("read %+v instead of %+v", got, q)
+			}
+			if r.Len() != 0 {
+				t.Fatalf("%s: %d bytes were left unread", q.Id, r.Len())
+			}
+		}
+	}
+}
+
+func TestPathReqInvalid(t *testing.T) {
+	valid := &PathReq{Id: "id", Dest: "1.2.3.4:80", Net: TCP, PType: Upload, Stripes: 1}
+	striped := &PathReq{Id: "id", Dest: "1.2.3.4:80", Net: TCP, PType: Upload, Stripe: 0, Stripes: 2}
+	// the offset of the first address byte, after the header and the id
+	const addr = handshakeHeaderSize + 2
+
+	tests := []struct {
+		name   string
+		req    *PathReq
+		modify func(b []byte) []byte
+		status int
+	}{
+		{"bad magic", valid, func(b []byte) []byte { b[0] = 'G'; return b }, int(StatusBadRequest)},
+		{"other version", valid, func(b []byte) []byte { b[2] = HandshakeVersion + 1; return b }, int(StatusVersionMismatch)},
+		{"unknown command", valid, func(b []byte) []byte { b[3] = 0x02; return b }, int(StatusBadRequest)},
+		{"unknown path type", valid, func(b []byte) []byte { b[4] = 0x03; return b }, int(StatusBadRequest)},
+		{"unknown flags", valid, func(b []byte) []byte { b[5] |= 0x80; return b }, int(StatusBadRequest)},
+		{"empty id", valid, func(b []byte) []byte { b[6] = 0; return b }, int(StatusBadRequest)},
+		{"long id", valid, func(b []byte) []byte { b[6] = MaxIdLength + 1; return b }, int(StatusBadRequest)},
+		{"empty domain", valid, func(b []byte) []byte {
+			return append(b[:addr], 0x03, 0, 0, 80)
+		}, int(StatusBadRequest)},
+		{"unknown address type", valid, func(b []byte) []byte { b[addr] = 0x02; return b }, int(StatusBadRequest)},
+		{"striped two way path", striped, func(b []byte) []byte { b[4] = byte(TwoWay); return b }, int(StatusBadRequest)},
+		{"single stripe", striped, func(b []byte) []byte { b[len(b)-1] = 1; return b }, int(StatusBadRequest)},
+		{"too many stripes", striped, func(b []byte) []byte { b[len(b)-1] = MaxStripes + 1; return b }, int(StatusBadRequest)},
+		{"stripe out of range", striped, func(b []byte) []byte { b[len(b)-2] = 2; return b }, int(StatusBadRequest)},
+		{"truncated", valid, func(b []byte) []byte { return b[:len(b)-1] }, -1},
+		{"truncated stripe", striped, func(b []byte) []byte { return b[:len(b)-1] }, -1},
+	}
+	for _, tt := range tests {
+		b := tt.modify(encodePathReq(t, tt.req, nil))
+		_, err := readPathReq(bytes.NewReader(b), nil)
+		if err == nil {
+			t.Fatalf("%s: the request was accepted", tt.name)
+		}
+		if status := handshakeStatus(err); status != tt.status {
+			t.Fatalf("%s: got status %d (%v) instead of %d", tt.name, status, err, tt.status)
+		}
+	}
+}
+
+func TestHandshakeReply(t *testing.T) {
+	for _, status := range []byte{StatusOK, StatusBadRequest, StatusConnectionRefused, StatusUnauthorized, StatusNoPartner} {
+		var b bytes.Buffer
+		if err := writeHandshakeReply(&b, status); err != nil {
+			t.Fatal(err)
+		}
+		err := readHandshakeReply(&b)
+		if status == StatusOK {
+			if err != nil {
+				t.Fatalf("an ok reply returned %v", err)
+			}
+			continue
+		}
+		if handshakeStatus(err) != int(status) {
+			t.Fatalf("status %d: got %v", status, err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		reply  []byte
+		status int
+	}{
+		{"other version", []byte{0x45, 0x47, HandshakeVersion + 1, StatusBadRequest}, int(StatusBadRequest)},
+		{"truncated", []byte{0x45, 0x47, HandshakeVersion}, -1},
+	}
+	for _, tt := range tests {
+		err := readHandshakeReply(bytes.NewReader(tt.reply))
+		if err == nil || handshakeStatus(err) != tt.status {
+			t.Fatalf("%s: got %v", tt.name, err)
+		}
+	}
+	if err := readHandshakeReply(bytes.NewReader([]byte{'H', 'T', 'T', 'P'})); err != ErrBadMagic {
+		t.Fatalf("a reply with a bad magic returned %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// IdlePool keeps tunnels dialed ahead of time, so that a new connection only
+// has to send its destination. idle tunnels are pinged to keep them alive and
+// to weed out dead ones, they're replaced once they're older than maxAge
+type IdlePool struct {
+	size     int
+	maxAge   time.Duration
+	interval time.Duration
+	dial     func() (net.Conn, error)
+	auth     *PSKAuth
+
+	mutex sync.Mutex
+	idle  []*idleTunnel
+	// wake asks the pool to refill after a tunnel has been taken
+	wake chan struct{}
+}
+
+type idleTunnel struct {
+	conn    net.Conn
+	created time.Time
+}
+
+// NewIdlePool starts keeping size tunnels ready, they're pinged every interval
+func NewIdlePool(size int, maxAge, interval time.Duration, auth *PSKAuth, dial func() (net.Conn, error)) *IdlePool {
+	p := &IdlePool{
+		size:     size,
+		maxAge:   maxAge,
+		interval: interval,
+		dial:     dial,
+		auth:     auth,
+		wake:     make(chan struct{}, 1),
+	}
+	go p.run()
+	return p
+}
+
+// Get returns an idle tunnel, or dials a new one when none is ready
+func (p *IdlePool) Get() (net.Conn, error) {
+	p.mutex.Lock()
+	var t *idleTunnel
+	for len(p.idle) > 0 && t == nil {
+		t = p.idle[0]
+		p.idle = p.idle[1:]
+		if time.Since(t.created) > p.maxAge {
+			t.conn.Close()
+			t = nil
+		}
+	}
+	p.mutex.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+	if t == nil {
+		return p.dial()
+	}
+	return t.conn, nil
+}
+
+func (p *IdlePool) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.fill()
+		select {
+		case <-p.wake:
+		case <-ticker.C:
+			p.check()
+		}
+	}
+}
+
+// fill dials tunnels until the pool is full, it gives up until the next
+// round on the first failure
+func (p *IdlePool) fill() {
+	for {
+		p.mutex.Lock()
+		full := len(p.idle) >= p.size
+		p.mutex.Unlock()
+		if full {
+			return
+		}
+
+		conn, err := p.dial()
+		if err == nil {
+			// the first ping makes sure the server accepts the tunnel
+			if err = pingTunnel(conn, p.auth); err != nil {
+				conn.Close()
+			}
+		}
+		if err != nil {
+			fmt.Println("unable to prepare idle tunnel:", err)
+			return
+		}
+
+		p.mutex.Lock()
+		p.idle = append(p.idle, &idleTunnel{conn, time.Now()})
+		p.mutex.Unlock()
+	}
+}
+
+// check pings the idle tunnels and drops the ones that are dead or too old,
+// they're taken out of the pool meanwhile
+func (p *IdlePool) check() {
+	p.mutex.Lock()
+	tunnels := p.idle
+	p.idle = nil
+	p.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	alive := make([]bool, len(tunnels))
+	for i, t := range tunnels {
+		if time.Since(t.created) > p.maxAge {
+			t.conn.Close()
+			continue
+		}
+		wg.Add(1)
+		go func(i int, t *idleTunnel) {
+			defer wg.Done()
+			if err := pingTunnel(t.conn, p.auth); err != nil {
+				fmt.Println("idle tunnel failed:", err)
+				t.conn.Close()
+				return
+			}
+			alive[i] = true
+		}(i, t)
+	}
+	wg.Wait()
+
+	p.mutex.Lock()
+	for i, t := range tunnels {
+		if alive[i] {
+			p.idle = append(p.idle, t)
+		}
+	}
+	p.mutex.Unlock()
+}
+
+// pingTunnel sends a keepalive handshake and waits for the server's reply
+func pingTunnel(conn net.Conn, auth *PSKAuth) error {
+	_ = conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	err := writePathReq(conn, &PathReq{
+		Id:    NewUUID(),
+		PType: Ping,
+	}, auth)
+	if err == nil {
+		err = readHandshakeReply(conn)
+	}
+	return err
+}
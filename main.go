@@ -2,7 +2,6 @@ package main
 
 import (
 	"egg/bufferpool"
-	"egg/socks5"
 	"errors"
 	"fmt"
 	"github.com/jessevdk/go-flags"
@@ -10,18 +9,82 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 )
 
 type ServerCMD struct {
-	Bind string `short:"b" long:"bind" default:":8585" description:"Binding address, where should server listen to. default :5858"`
+	Bind              string        `short:"b" long:"bind" default:":8585" description:"Binding address, where should server listen to. default :5858"`
+	Secret            string        `short:"p" long:"psk" description:"Pre-shared key clients must authenticate with, tunnels without a valid signature are rejected. default: no authentication"`
+	RequireEncryption bool          `long:"require-encryption" description:"Reject tunnels that don't use the inner encryption layer, it needs --psk. default: false"`
+	Path              string        `long:"path" default:"/ws" description:"Path prefix of tunnels, every path below it is accepted too so clients can randomize it. default: /ws"`
+	PathToken         string        `long:"path-token" description:"Secret path segment appended to --path, clients must include it in their server url. ex. /ws/<token>"`
+	DecoyDir          string        `long:"decoy-dir" description:"Directory of a static website to serve to everything that isn't a tunnel, with index.html and 404.html support. default: plain 404 responses"`
+	DecoyURL          string        `long:"decoy-url" description:"Real website to reverse proxy everything that isn't a tunnel to, it overrides --decoy-dir. ex. https://example.com"`
+	QUIC              bool          `long:"quic" description:"Also serve QUIC tunnels on UDP at the --bind address, it needs TLS to be configured. default: false"`
+	TCP               string        `long:"tcp" description:"Also serve raw TCP tunnels at this address, with TLS when it's configured. they carry no HTTP at all, so a relay can forward to them. ex. :5859"`
+	PairTimeout       time.Duration `long:"pair-timeout" default:"10s" description:"How long the upload or download path of a split connection waits for the other path before it's refused. default: 10s"`
+	Fallback          string        `long:"fallback" description:"Where requests to the tunnel path go when they aren't valid or authenticated upgrades, an http(s) url to reverse proxy to or tcp://host:port to splice the connection with. default: answer like the decoy"`
+	Deny              []string      `long:"deny" description:"Destination tunnels may not connect to, an ip, a cidr or a domain including its subdomains, can be repeated. clients are answered with a rule failure. ex. 10.0.0.0/8 or example.com"`
+
+	CertFile      string   `long:"tls-cert" description:"Certificate file to serve HTTPS with, it's reloaded when it changes on disk"`
+	KeyFile       string   `long:"tls-key" description:"Private key file of the certificate"`
+	SelfSigned    bool     `long:"self-signed" description:"Serve HTTPS with a self-signed certificate and print its fingerprint for pinning, it's stored in --tls-cert and --tls-key when they're set"`
+	Hosts         []string `long:"tls-host" description:"Host name or ip of the self-signed certificate, can be repeated. default: localhost"`
+	ACMEDomains   []string `long:"acme-domain" description:"Obtain a certificate for this domain via ACME, can be repeated"`
+	ACMEEmail     string   `long:"acme-email" description:"Contact email of the ACME account"`
+	ACMEDirectory string   `long:"acme-directory" default:"https://acme-v02.api.letsencrypt.org/directory" description:"ACME directory url, ex. a local Pebble at https://localhost:14000/dir"`
+	ACMECache     string   `long:"acme-cache" default:"acme-cache" description:"Directory ACME account and certificates are cached in"`
+	ACMECAFile    string   `long:"acme-ca" description:"PEM bundle to trust when talking to the ACME directory"`
+	ACMEHTTPBind  string   `long:"acme-http" description:"Address to serve ACME HTTP-01 challenges on, ex. :80. TLS-ALPN-01 challenges are always served on --bind"`
 }
 
 func (s *ServerCMD) Execute(_ []string) error {
 	// run server mode, ie open http server and listen to incoming requests from internet
 	fmt.Printf("Starting server at %s ...\n", s.Bind)
-	srv := NewServer()
-	err := srv.ListenAndServe(s.Bind)
+	tlsConfig, err := newServerTLSConfig(ServerTLSOptions{
+		CertFile:      s.CertFile,
+		KeyFile:       s.KeyFile,
+		SelfSigned:    s.SelfSigned,
+		Hosts:         s.Hosts,
+		ACMEDomains:   s.ACMEDomains,
+		ACMEEmail:     s.ACMEEmail,
+		ACMEDirectory: s.ACMEDirectory,
+		ACMECache:     s.ACMECache,
+		ACMECAFile:    s.ACMECAFile,
+		ACMEHTTPBind:  s.ACMEHTTPBind,
+	})
+	if err != nil {
+		fmt.Printf("unable to setup tls: %s\n", err)
+		return err
+	}
+	srv, err := NewServer(ServerConfig{
+		Secret:            s.Secret,
+		RequireEncryption: s.RequireEncryption,
+		Path:              s.Path,
+		PathToken:         s.PathToken,
+		Decoy: DecoyOptions{
+			Dir:      s.DecoyDir,
+			ProxyURL: s.DecoyURL,
+		},
+		PairTimeout: s.PairTimeout,
+		Fallback:    s.Fallback,
+		Deny:        s.Deny,
+	})
+	if err != nil {
+		fmt.Printf("unable to start server: %s\n", err)
+		return err
+	}
+	errCh := make(chan error, 3)
+	if s.QUIC {
+		go func() { errCh <- srv.ListenAndServeQUIC(s.Bind, tlsConfig) }()
+	}
+	if s.TCP != "" {
+		go func() { errCh <- srv.ListenAndServeTCP(s.TCP, tlsConfig) }()
+	}
+	go func() { errCh <- srv.ListenAndServe(s.Bind, tlsConfig) }()
+	err = <-errCh
 	if errors.Is(err, http.ErrServerClosed) {
 		fmt.Printf("server closed\n")
 		return err
@@ -35,25 +98,97 @@ func (s *ServerCMD) Execute(_ []string) error {
 var serverCMD ServerCMD
 
 type ClientCMD struct {
-	Bind     string `short:"b" long:"bind" default:":8585" description:"Binding address, where should socks proxy server listen to. default :5858"`
-	Server   string `short:"s" long:"server" default:"ws://127.0.0.1:8585/ws" description:"Remote websocket server address, it should starts with ws or wss and ends with ws path ex. wss://example.com/ws"`
-	Upath    string `short:"u" long:"upload" description:"Uploading part of connections will be forwarded to <ip>:<port>. for using it you must setup relay server first, then provide this argument with address of forwarding server. ex. example.com:5858"`
-	Insecure bool   `short:"k" long:"insecure" description:"Allow to connect to insecure endpoints default: false. (not recommended)"`
+	Bind            string        `short:"b" long:"bind" default:":8585" description:"Binding address, where should socks proxy server listen to. default :5858"`
+	Server          []string      `short:"s" long:"server" default:"ws://127.0.0.1:8585/ws" description:"Remote server address, can be repeated to balance connections over several servers. it should starts with ws or wss for websocket tunnels, h2s (TLS) or h2 (cleartext) for HTTP/2 stream tunnels, polls (TLS) or poll (plain HTTP) for tunnels over ordinary HTTP requests, quic for QUIC tunnels, or tcps (TLS) or tcp for raw tunnels to the server's --tcp address, and ends with the server's --path and --path-token ex. wss://example.com/ws. settings of a single server can be given as a fragment: #connect=<addr>&sni=<name>&host=<name>&fingerprint=<name>"`
+	Upath           []string      `short:"u" long:"upload" description:"Endpoint of the upload path of connections, so that uploads and downloads take independent paths to the server. it takes the same schemes and settings as --server, so every direction can use its own transport, and a bare <ip>:<port> is a relay forwarding to the server's --bind address, see the relay command. several relays can be given as a comma separated list, they're rotated and the ones failing to connect are blacklisted for a while. given once per --server. ex. tcp://relay.example.com:5859 or 1.2.3.4:5858,5.6.7.8:5858"`
+	Dpath           []string      `long:"download" description:"Endpoint of the download path of connections, like --upload. default: the --server endpoint"`
+	Insecure        bool          `short:"k" long:"insecure" description:"Skip verification of the server certificate. default: false. (not recommended)"`
+	PinCert         string        `long:"pin-cert" description:"SHA-256 fingerprint of the server certificate in hex or base64, the pinned certificate is trusted even if it's self-signed"`
+	PinPubKey       string        `long:"pin-pubkey" description:"SHA-256 fingerprint of the server public key (SPKI) in hex or base64, the pinned key is trusted even if its certificate is self-signed"`
+	CAFile          string        `long:"ca" description:"PEM bundle of certificate authorities to trust instead of the system ones"`
+	Fingerprint     string        `short:"f" long:"fingerprint" default:"android" choice:"android" choice:"chrome" choice:"firefox" choice:"safari" choice:"ios" choice:"edge" choice:"randomized" choice:"randomized-noalpn" description:"TLS ClientHello fingerprint to mimic, ALPN is always limited to http/1.1 for the websocket upgrade. default: android"`
+	FingerprintFile string        `long:"fingerprint-file" description:"JSON file with a custom ClientHello spec in the uTLS format, it overrides --fingerprint"`
+	ConnectAddr     string        `long:"connect" description:"Address to connect to instead of the server's host, ex. an ip of a CDN edge. the port of --server is used when it's omitted"`
+	SNI             string        `long:"sni" description:"TLS server name to send instead of the server's host"`
+	NoSNI           bool          `long:"no-sni" description:"Send no TLS server name at all, the certificate is still verified against the server's host"`
+	Host            string        `long:"host" description:"HTTP Host header of the websocket upgrade instead of the server's host"`
+	UserAgent       string        `long:"user-agent" description:"User-Agent header of the websocket upgrade"`
+	Headers         []string      `short:"H" long:"header" description:"Extra header of the websocket upgrade, can be repeated. ex. \"X-Forwarded-For: 1.2.3.4\""`
+	Randomize       string        `long:"randomize" choice:"path" choice:"query" description:"Randomize the websocket url of every connection, either by appending a random path segment or a random query parameter. default: disabled"`
+	Mux             int           `short:"m" long:"mux" default:"0" description:"Number of long-lived websockets to multiplex connections over, 0 opens a new websocket per connection. default: 0"`
+	Secret          string        `short:"p" long:"psk" description:"Pre-shared key to authenticate tunnels with, it must match the server's key"`
+	Encryption      string        `short:"e" long:"encryption" choice:"chacha20-poly1305" choice:"aes-256-gcm" description:"Encrypt tunnels inside of TLS, so that their content stays private even where TLS is terminated by a CDN. it needs --psk, which authenticates the key exchange. default: disabled"`
+	IdleConns       int           `long:"idle-conns" default:"0" description:"Number of tunnels to keep connected ahead of time, so that new connections skip the handshakes. it doesn't apply with --mux. default: 0"`
+	IdleMaxAge      time.Duration `long:"idle-max-age" default:"5m" description:"How long an idle tunnel is kept before it's replaced by a fresh one. default: 5m"`
+	IdlePing        time.Duration `long:"idle-ping" default:"30s" description:"How often idle tunnels are pinged to keep them alive and detect dead ones, it must be less than 2m. default: 30s"`
+	Balance         string        `long:"balance" default:"round-robin" choice:"round-robin" choice:"random" choice:"least-conn" choice:"rtt" description:"How the server of a connection is picked when there are several, rtt picks the one answering pings the fastest. servers failing to connect are skipped until they answer again. default: round-robin"`
+	ProbeInterval   time.Duration `long:"probe-interval" default:"30s" description:"How often servers that are down are probed, and every server with --balance rtt. default: 30s"`
+	Retries         int           `long:"retries" default:"2" description:"How often a failed tunnel is retried before the socks client gets a failure, retries move on to other servers when there are several. default: 2"`
+	RetryBackoff    time.Duration `long:"retry-backoff" default:"250ms" description:"Wait before the first retry, it doubles with every retry and is randomized by half of it. default: 250ms"`
+	ConnectTimeout  time.Duration `long:"connect-timeout" default:"20s" description:"Overall time a connection may spend on its attempts, 0 disables it. default: 20s"`
+	Stripes         int           `long:"stripes" default:"1" description:"Number of parallel download tunnels of every tcp connection, the server stripes the data over them and the client puts it back in order. it helps where the throughput of a single tunnel is throttled. default: 1"`
+	UploadStripes   int           `long:"upload-stripes" default:"1" description:"Number of parallel upload tunnels of every tcp connection, like --stripes. default: 1"`
+	RelayRotate     string        `long:"relay-rotate" default:"connection" choice:"connection" choice:"failure" description:"When the upload path moves on to its next relay, with every connection or only once the current relay fails to connect. default: connection"`
+	RelayBlacklist  time.Duration `long:"relay-blacklist" default:"1m" description:"How long a relay that failed to connect is skipped, unless every relay is. default: 1m"`
+	RelayReport     time.Duration `long:"relay-report" default:"5m" description:"How often the health of the relays is logged, 0 disables it. default: 5m"`
+	Optimistic      bool          `long:"optimistic" description:"Reply to socks clients before the server connects to the destination, it's faster but unreachable destinations look like dropped connections. default: false"`
 }
 
 func (c *ClientCMD) Execute(_ []string) error {
 	// run client mode, ie open http server and listen to incoming requests from internet
 	fmt.Printf("Starting client at %s ...\n", c.Bind)
-	var srv *socks5.Server
-	if c.Upath != "" {
-		u, _ := url.Parse(c.Server)
-		RelayAddress = c.Upath
-		RelayAddressToReplace = u.Host
-		srv, _ = NewClient(c.Server, true)
-	} else {
-		srv, _ = NewClient(c.Server, false)
+	cfg := ClientConfig{
+		Balance:         c.Balance,
+		ProbeInterval:   c.ProbeInterval,
+		MuxConns:        c.Mux,
+		IdleConns:       c.IdleConns,
+		IdleMaxAge:      c.IdleMaxAge,
+		IdlePing:        c.IdlePing,
+		Optimistic:      c.Optimistic,
+		DownloadStripes: c.Stripes,
+		UploadStripes:   c.UploadStripes,
+		Relays: RelayOptions{
+			Rotate:         c.RelayRotate,
+			Blacklist:      c.RelayBlacklist,
+			ReportInterval: c.RelayReport,
+		},
+		Retry: RetryOptions{
+			Retries:  c.Retries,
+			Backoff:  c.RetryBackoff,
+			Deadline: c.ConnectTimeout,
+		},
+		Secret:          c.Secret,
+		Encryption:      c.Encryption,
+		Fingerprint:     c.Fingerprint,
+		FingerprintFile: c.FingerprintFile,
+		Fronting: FrontingOptions{
+			ConnectAddr: c.ConnectAddr,
+			SNI:         c.SNI,
+			OmitSNI:     c.NoSNI,
+			Host:        c.Host,
+			UserAgent:   c.UserAgent,
+			Headers:     c.Headers,
+			Randomize:   c.Randomize,
+		},
+		TLS: TLSOptions{
+			Insecure:  c.Insecure,
+			PinCert:   c.PinCert,
+			PinPubKey: c.PinPubKey,
+			CAFile:    c.CAFile,
+		},
+	}
+	servers, err := c.servers()
+	if err != nil {
+		fmt.Printf("unable to start client: %v\n", err)
+		return err
+	}
+	cfg.Servers = servers
+	srv, err := NewClient(cfg)
+	if err != nil {
+		fmt.Printf("unable to start client: %v\n", err)
+		return err
 	}
-	err := srv.ListenAndServe("tcp", c.Bind)
+	err = srv.ListenAndServe("tcp", c.Bind)
 	if err != nil {
 		fmt.Printf("unable to listen to %s\n", c.Bind)
 		return err
@@ -61,6 +196,40 @@ func (c *ClientCMD) Execute(_ []string) error {
 	return nil
 }
 
+// servers pairs every --server with its --upload and --download endpoints
+func (c *ClientCMD) servers() ([]UpstreamConfig, error) {
+	if len(c.Upath) != 0 && len(c.Upath) != len(c.Server) {
+		return nil, errors.New("--upload must be given once per --server")
+	}
+	if len(c.Dpath) != 0 && len(c.Dpath) != len(c.Server) {
+		return nil, errors.New("--download must be given once per --server")
+	}
+	servers := make([]UpstreamConfig, len(c.Server))
+	for i, endpoint := range c.Server {
+		servers[i].Endpoint = endpoint
+		if len(c.Upath) != 0 {
+			servers[i].Upload = c.Upath[i]
+			if !strings.Contains(c.Upath[i], "://") {
+				// bare addresses are relays forwarding to the server
+				servers[i].Upload = withSetting(endpoint, "relays", c.Upath[i])
+			}
+		}
+		if len(c.Dpath) != 0 {
+			servers[i].Download = c.Dpath[i]
+		}
+	}
+	return servers, nil
+}
+
+// withSetting adds a per-server setting to the fragment of endpoint
+func withSetting(endpoint, key, value string) string {
+	setting := url.Values{key: {value}}.Encode()
+	if strings.Contains(endpoint, "#") {
+		return endpoint + "&" + setting
+	}
+	return endpoint + "#" + setting
+}
+
 var clientCMD ClientCMD
 
 type RelayCMD struct {
@@ -104,7 +273,7 @@ func cleanup() {
 }
 
 func main() {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
@@ -0,0 +1,78 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Every frame exchanged over a multiplexed connection is formed as follows:
+//
+// +-----+-----------+--------+----------+
+// | CMD | STREAM ID | LENGTH |  PAYLOAD |
+// +-----+-----------+--------+----------+
+// |  1  |     4     |   2    | Variable |
+// +-----+-----------+--------+----------+
+//
+// STREAM ID and LENGTH are big endian. Streams opened by the client side
+// carry odd ids and streams opened by the server side carry even ids.
+const (
+	// cmdSYN opens a new stream, it has no payload
+	cmdSYN byte = iota
+	// cmdPSH carries stream data
+	cmdPSH
+	// cmdFIN closes a stream, it has no payload
+	cmdFIN
+	// cmdUPD returns send window to the peer, its payload is a 4 byte
+	// big endian number of bytes consumed by the reader since the last update
+	cmdUPD
+	// cmdNOP keeps the session alive, it has no payload and is ignored
+	cmdNOP
+)
+
+const (
+	headerSize = 7
+	// MaxFrameSize is the largest payload a single frame can carry
+	MaxFrameSize = 16 * 1024
+)
+
+var errInvalidFrame = errors.New("mux: invalid frame")
+
+type frame struct {
+	cmd  byte
+	sid  uint32
+	data []byte
+}
+
+func (f frame) bytes() []byte {
+	b := make([]byte, headerSize+len(f.data))
+	b[0] = f.cmd
+	binary.BigEndian.PutUint32(b[1:], f.sid)
+	binary.BigEndian.PutUint16(b[5:], uint16(len(f.data)))
+	copy(b[headerSize:], f.data)
+	return b
+}
+
+func readFrame(r io.Reader, header []byte) (frame, error) {
+	if _, err := io.ReadFull(r, header[:headerSize]); err != nil {
+		return frame{}, err
+	}
+	f := frame{
+		cmd: header[0],
+		sid: binary.BigEndian.Uint32(header[1:]),
+	}
+	if f.cmd > cmdNOP {
+		return frame{}, errInvalidFrame
+	}
+	length := int(binary.BigEndian.Uint16(header[5:]))
+	if length > MaxFrameSize {
+		return frame{}, errInvalidFrame
+	}
+	if length > 0 {
+		f.data = make([]byte, length)
+		if _, err := io.ReadFull(r, f.data); err != nil {
+			return frame{}, err
+		}
+	}
+	return f, nil
+}
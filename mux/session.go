@@ -0,0 +1,277 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// InitialWindow is the number of bytes a stream may send before the peer
+// acknowledges them with a window update
+const InitialWindow = 256 * 1024
+
+// both sides of a session send a NOP frame every keepAliveInterval, a session
+// that receives nothing for keepAliveTimeout is dead and closed
+var (
+	keepAliveInterval = 10 * time.Second
+	keepAliveTimeout  = 30 * time.Second
+)
+
+// acceptBacklog is the number of opened streams waiting for AcceptStream,
+// streams the peer opens beyond it are refused
+const acceptBacklog = 1024
+
+var (
+	ErrSessionClosed = errors.New("mux: session closed")
+	ErrStreamClosed  = errors.New("mux: stream closed")
+	ErrStreamReset   = errors.New("mux: stream reset, the peer exceeded its window")
+	ErrTimeout       = &timeoutError{}
+	errKeepAlive     = errors.New("mux: the peer stopped responding")
+)
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "mux: i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// Session multiplexes many streams over a single underlying connection
+type Session struct {
+	conn io.ReadWriteCloser
+
+	writeMutex sync.Mutex
+
+	streamsMutex sync.Mutex
+	streams      map[uint32]*Stream
+	nextID       uint32
+
+	acceptCh chan *Stream
+	// idle closes the session once nothing has been received for idleTimeout
+	idle        *time.Timer
+	idleTimeout time.Duration
+
+	die       chan struct{}
+	closeOnce sync.Once
+	err       atomic.Value
+}
+
+// Client returns the client side of a session running over conn
+func Client(conn io.ReadWriteCloser) *Session {
+	return newSession(conn, 1)
+}
+
+// Server returns the server side of a session running over conn
+func Server(conn io.ReadWriteCloser) *Session {
+	return newSession(conn, 2)
+}
+
+func newSession(conn io.ReadWriteCloser, firstID uint32) *Session {
+	s := &Session{
+		conn:     conn,
+		streams:  make(map[uint32]*Stream),
+		nextID:   firstID,
+		acceptCh: make(chan *Stream, acceptBacklog),
+		die:      make(chan struct{}),
+	}
+	s.idleTimeout = keepAliveTimeout
+	s.idle = time.AfterFunc(s.idleTimeout, func() {
+		_ = s.closeWithError(errKeepAlive)
+	})
+	go s.recvLoop()
+	go s.keepAlive(keepAliveInterval)
+	return s
+}
+
+// OpenStream opens a new stream to the peer
+func (s *Session) OpenStream() (*Stream, error) {
+	if s.IsClosed() {
+		return nil, ErrSessionClosed
+	}
+
+	s.streamsMutex.Lock()
+	sid := s.nextID
+	s.nextID += 2
+	stream := newStream(sid, s)
+	s.streams[sid] = stream
+	s.streamsMutex.Unlock()
+
+	if err := s.writeFrame(frame{cmd: cmdSYN, sid: sid}); err != nil {
+		s.removeStream(sid)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// AcceptStream waits for the peer to open a new stream
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case stream := <-s.acceptCh:
+		return stream, nil
+	case <-s.die:
+		return nil, s.closeErr()
+	}
+}
+
+// NumStreams returns the number of currently open streams
+func (s *Session) NumStreams() int {
+	s.streamsMutex.Lock()
+	defer s.streamsMutex.Unlock()
+	return len(s.streams)
+}
+
+// IsClosed reports whether the session has been closed
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// CloseChan returns a channel that is closed once the session dies
+func (s *Session) CloseChan() <-chan struct{} {
+	return s.die
+}
+
+// Close closes the session and all of its streams
+func (s *Session) Close() error {
+	return s.closeWithError(ErrSessionClosed)
+}
+
+func (s *Session) closeWithError(err error) error {
+	var closeErr error = ErrSessionClosed
+	s.closeOnce.Do(func() {
+		s.err.Store(err)
+		close(s.die)
+		s.idle.Stop()
+		closeErr = s.conn.Close()
+
+		s.streamsMutex.Lock()
+		for sid, stream := range s.streams {
+			stream.remoteClose()
+			delete(s.streams, sid)
+		}
+		s.streamsMutex.Unlock()
+	})
+	return closeErr
+}
+
+func (s *Session) closeErr() error {
+	if err, ok := s.err.Load().(error); ok {
+		return err
+	}
+	return ErrSessionClosed
+}
+
+func (s *Session) LocalAddr() net.Addr {
+	if c, ok := s.conn.(net.Conn); ok {
+		return c.LocalAddr()
+	}
+	return nil
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	if c, ok := s.conn.(net.Conn); ok {
+		return c.RemoteAddr()
+	}
+	return nil
+}
+
+func (s *Session) removeStream(sid uint32) {
+	s.streamsMutex.Lock()
+	delete(s.streams, sid)
+	s.streamsMutex.Unlock()
+}
+
+func (s *Session) writeFrame(f frame) error {
+	// a single write per frame, so frames of different streams never interleave
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	if s.IsClosed() {
+		return s.closeErr()
+	}
+	if _, err := s.conn.Write(f.bytes()); err != nil {
+		_ = s.closeWithError(err)
+		return err
+	}
+	return nil
+}
+
+func (s *Session) recvLoop() {
+	header := make([]byte, headerSize)
+	for {
+		f, err := readFrame(s.conn, header)
+		if err != nil {
+			_ = s.closeWithError(err)
+			return
+		}
+		s.idle.Reset(s.idleTimeout)
+
+		switch f.cmd {
+		case cmdSYN:
+			s.streamsMutex.Lock()
+			if _, exists := s.streams[f.sid]; exists {
+				s.streamsMutex.Unlock()
+				continue
+			}
+			stream := newStream(f.sid, s)
+			s.streams[f.sid] = stream
+			s.streamsMutex.Unlock()
+
+			select {
+			case s.acceptCh <- stream:
+			default:
+				// nobody is accepting, the stream is refused rather than
+				// holding up the streams that are already open
+				s.removeStream(f.sid)
+				go s.writeFrame(frame{cmd: cmdFIN, sid: f.sid})
+			}
+		case cmdPSH:
+			if stream := s.stream(f.sid); stream != nil && !stream.pushData(f.data) {
+				stream.reset()
+			}
+		case cmdFIN:
+			if stream := s.stream(f.sid); stream != nil {
+				stream.remoteClose()
+				s.removeStream(f.sid)
+			}
+		case cmdUPD:
+			if len(f.data) != 4 {
+				_ = s.closeWithError(errInvalidFrame)
+				return
+			}
+			if stream := s.stream(f.sid); stream != nil {
+				stream.windowUpdate(binary.BigEndian.Uint32(f.data))
+			}
+		}
+	}
+}
+
+// keepAlive sends NOP frames until the session dies, so that the peer's
+// idle timer doesn't expire while no stream is busy
+func (s *Session) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.writeFrame(frame{cmd: cmdNOP}); err != nil {
+				return
+			}
+		case <-s.die:
+			return
+		}
+	}
+}
+
+func (s *Session) stream(sid uint32) *Stream {
+	s.streamsMutex.Lock()
+	defer s.streamsMutex.Unlock()
+	return s.streams[sid]
+}
@@ -0,0 +1,280 @@
+package mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sessions returns both sides of a session over an in-memory connection
+func sessions(t *testing.T) (*Session, *Session) {
+	c1, c2 := net.Pipe()
+	client, server := Client(c1), Server(c2)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// rawPeer returns the server side of a session whose client side is driven
+// by hand, the frames the session sends are delivered on the channel
+func rawPeer(t *testing.T) (*Session, net.Conn, <-chan frame) {
+	c1, c2 := net.Pipe()
+	server := Server(c2)
+	t.Cleanup(func() {
+		server.Close()
+		c1.Close()
+	})
+	frames := make(chan frame, 16)
+	go func() {
+		defer close(frames)
+		header := make([]byte, headerSize)
+		for {
+			f, err := readFrame(c1, header)
+			if err != nil {
+				return
+			}
+			frames <- f
+		}
+	}()
+	return server, c1, frames
+}
+
+func writeFrames(t *testing.T, conn net.Conn, frames ...frame) {
+	for _, f := range frames {
+		if _, err := conn.Write(f.bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// waitFIN waits for the session to close sid
+func waitFIN(t *testing.T, frames <-chan frame, sid uint32) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case f, ok := <-frames:
+			if !ok {
+				t.Fatal("the session closed before stream", sid)
+			}
+			if f.cmd == cmdFIN && f.sid == sid {
+				return
+			}
+		case <-timeout:
+			t.Fatal("stream", sid, "wasn't closed")
+		}
+	}
+}
+
+func randomData(t *testing.T, size int) []byte {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestStreams(t *testing.T) {
+	client, server := sessions(t)
+
+	// the server echoes every stream
+	go func() {
+		for {
+			stream, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(stream, stream)
+				stream.Close()
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream, err := client.OpenStream()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer stream.Close()
+
+			// more than a window, so that it only goes through with updates
+			data := randomData(t, 3*InitialWindow)
+			go stream.Write(data)
+			out := make([]byte, len(data))
+			if _, err := io.ReadFull(stream, out); err != nil {
+				t.Errorf("stream %d: %v", stream.ID(), err)
+				return
+			}
+			if !bytes.Equal(out, data) {
+				t.Errorf("stream %d echoed other data", stream.ID())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestStreamClose(t *testing.T) {
+	client, server := sessions(t)
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(accepted)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("read %q, %v instead of the data and EOF", data, err)
+	}
+	if _, err := accepted.Write([]byte("x")); err == nil {
+		t.Fatal("writing to a stream the peer closed succeeded")
+	}
+}
+
+func TestSendWindow(t *testing.T) {
+	client, server := sessions(t)
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is read, so the writer stops at the window
+	stream.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := stream.Write(make([]byte, 2*InitialWindow))
+	if !errors.Is(err, ErrTimeout) || n != InitialWindow {
+		t.Fatalf("wrote %d bytes and got %v, expected a timeout after %d", n, err, InitialWindow)
+	}
+
+	// reading returns the window to the writer
+	go io.ReadFull(accepted, make([]byte, InitialWindow+1024))
+	stream.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := stream.Write(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReceiveWindow(t *testing.T) {
+	server, conn, frames := rawPeer(t)
+
+	writeFrames(t, conn, frame{cmd: cmdSYN, sid: 1})
+	stream, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the peer sends a whole window and ignores that nothing is read
+	chunk := make([]byte, MaxFrameSize)
+	for sent := 0; sent < InitialWindow; sent += len(chunk) {
+		writeFrames(t, conn, frame{cmd: cmdPSH, sid: 1, data: chunk})
+	}
+	writeFrames(t, conn, frame{cmd: cmdPSH, sid: 1, data: chunk})
+
+	waitFIN(t, frames, 1)
+	if _, err := stream.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Fatalf("Read returned %v instead of ErrStreamReset", err)
+	}
+	if _, err := stream.Write([]byte("x")); err != ErrStreamReset {
+		t.Fatalf("Write returned %v instead of ErrStreamReset", err)
+	}
+
+	// the other streams go on
+	writeFrames(t, conn, frame{cmd: cmdSYN, sid: 3}, frame{cmd: cmdPSH, sid: 3, data: []byte("ok")})
+	other, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(other, b); err != nil || string(b) != "ok" {
+		t.Fatalf("read %q, %v from another stream", b, err)
+	}
+}
+
+func TestAcceptBacklog(t *testing.T) {
+	server, conn, frames := rawPeer(t)
+
+	// nobody accepts, the stream beyond the backlog is refused
+	for i := 0; i <= acceptBacklog; i++ {
+		writeFrames(t, conn, frame{cmd: cmdSYN, sid: uint32(2*i + 1)})
+	}
+	refused := uint32(2*acceptBacklog + 1)
+	waitFIN(t, frames, refused)
+
+	// the receive loop isn't held up by the backlog
+	writeFrames(t, conn, frame{cmd: cmdPSH, sid: 1, data: []byte("ok")})
+	stream, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.ID() != 1 {
+		t.Fatalf("accepted stream %d instead of 1", stream.ID())
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(stream, b); err != nil || string(b) != "ok" {
+		t.Fatalf("read %q, %v", b, err)
+	}
+	if server.NumStreams() != acceptBacklog {
+		t.Fatalf("%d streams are open instead of %d", server.NumStreams(), acceptBacklog)
+	}
+}
+
+func TestInvalidFrame(t *testing.T) {
+	server, conn, _ := rawPeer(t)
+
+	conn.Write([]byte{cmdNOP + 1, 0, 0, 0, 1, 0, 0})
+	select {
+	case <-server.CloseChan():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session wasn't closed")
+	}
+	if _, err := server.AcceptStream(); err != errInvalidFrame {
+		t.Fatalf("AcceptStream returned %v instead of errInvalidFrame", err)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	interval, timeout := keepAliveInterval, keepAliveTimeout
+	keepAliveInterval, keepAliveTimeout = 20*time.Millisecond, 100*time.Millisecond
+	defer func() { keepAliveInterval, keepAliveTimeout = interval, timeout }()
+
+	// idle sessions stay open as long as both sides are alive
+	client, server := sessions(t)
+	time.Sleep(5 * keepAliveTimeout)
+	if client.IsClosed() || server.IsClosed() {
+		t.Fatal("an idle session was closed")
+	}
+
+	// a peer that sends nothing is dead
+	server, _, _ = rawPeer(t)
+	select {
+	case <-server.CloseChan():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session wasn't closed")
+	}
+	if _, err := server.AcceptStream(); err != errKeepAlive {
+		t.Fatalf("AcceptStream returned %v instead of errKeepAlive", err)
+	}
+}
@@ -0,0 +1,265 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Stream is a single bidirectional byte stream carried by a Session,
+// it implements net.Conn
+type Stream struct {
+	id   uint32
+	sess *Session
+
+	mutex      sync.Mutex
+	buffer     bytes.Buffer
+	consumed   uint32
+	sendWindow int64
+	// recvWindow is what the peer may still send before the next window update
+	recvWindow   int64
+	remoteClosed bool
+	localClosed  bool
+	// broken is set once the peer has exceeded its window
+	broken bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	// readNotify and writeNotify wake up blocked readers and writers
+	readNotify  chan struct{}
+	writeNotify chan struct{}
+
+	die       chan struct{}
+	closeOnce sync.Once
+}
+
+func newStream(id uint32, sess *Session) *Stream {
+	return &Stream{
+		id:          id,
+		sess:        sess,
+		sendWindow:  InitialWindow,
+		recvWindow:  InitialWindow,
+		readNotify:  make(chan struct{}, 1),
+		writeNotify: make(chan struct{}, 1),
+		die:         make(chan struct{}),
+	}
+}
+
+// ID returns the stream id
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		st.mutex.Lock()
+		if st.broken {
+			st.mutex.Unlock()
+			return 0, ErrStreamReset
+		}
+		if st.buffer.Len() > 0 {
+			n, _ := st.buffer.Read(b)
+			st.consumed += uint32(n)
+			var update uint32
+			// return consumed window to the peer once half of it is used up
+			if st.consumed >= InitialWindow/2 {
+				update, st.consumed = st.consumed, 0
+				st.recvWindow += int64(update)
+			}
+			st.mutex.Unlock()
+
+			if update > 0 {
+				data := make([]byte, 4)
+				binary.BigEndian.PutUint32(data, update)
+				_ = st.sess.writeFrame(frame{cmd: cmdUPD, sid: st.id, data: data})
+			}
+			return n, nil
+		}
+		if st.remoteClosed {
+			st.mutex.Unlock()
+			return 0, io.EOF
+		}
+		if st.localClosed {
+			st.mutex.Unlock()
+			return 0, ErrStreamClosed
+		}
+		deadline := st.readDeadline
+		st.mutex.Unlock()
+
+		if err := st.wait(st.readNotify, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *Stream) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		st.mutex.Lock()
+		if st.broken {
+			st.mutex.Unlock()
+			return written, ErrStreamReset
+		}
+		if st.localClosed {
+			st.mutex.Unlock()
+			return written, ErrStreamClosed
+		}
+		if st.remoteClosed {
+			st.mutex.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		window := st.sendWindow
+		deadline := st.writeDeadline
+		st.mutex.Unlock()
+
+		if window <= 0 {
+			if err := st.wait(st.writeNotify, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+
+		n := len(b) - written
+		if n > MaxFrameSize {
+			n = MaxFrameSize
+		}
+		if int64(n) > window {
+			n = int(window)
+		}
+
+		st.mutex.Lock()
+		st.sendWindow -= int64(n)
+		st.mutex.Unlock()
+
+		if err := st.sess.writeFrame(frame{cmd: cmdPSH, sid: st.id, data: b[written : written+n]}); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// wait blocks until notify fires, the stream or session dies or the deadline passes
+func (st *Stream) wait(notify chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return ErrTimeout
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-notify:
+		return nil
+	case <-st.die:
+		return nil
+	case <-st.sess.die:
+		return st.sess.closeErr()
+	case <-timeout:
+		return ErrTimeout
+	}
+}
+
+// Close closes the stream and informs the peer
+func (st *Stream) Close() error {
+	st.closeOnce.Do(func() {
+		st.mutex.Lock()
+		st.localClosed = true
+		st.mutex.Unlock()
+		close(st.die)
+
+		_ = st.sess.writeFrame(frame{cmd: cmdFIN, sid: st.id})
+		st.sess.removeStream(st.id)
+	})
+	return nil
+}
+
+// pushData buffers data from the peer, it reports false and drops the data
+// when it exceeds the receive window
+func (st *Stream) pushData(data []byte) bool {
+	st.mutex.Lock()
+	if int64(len(data)) > st.recvWindow {
+		st.mutex.Unlock()
+		return false
+	}
+	st.recvWindow -= int64(len(data))
+	st.buffer.Write(data)
+	st.mutex.Unlock()
+	notify(st.readNotify)
+	return true
+}
+
+// reset ends a stream whose peer exceeded its window, reads and writes fail
+// and the peer is told the stream is closed
+func (st *Stream) reset() {
+	st.mutex.Lock()
+	st.broken = true
+	st.buffer.Reset()
+	st.mutex.Unlock()
+	st.remoteClose()
+	st.sess.removeStream(st.id)
+	// the receive loop doesn't wait for writes
+	go st.sess.writeFrame(frame{cmd: cmdFIN, sid: st.id})
+}
+
+func (st *Stream) windowUpdate(n uint32) {
+	st.mutex.Lock()
+	st.sendWindow += int64(n)
+	st.mutex.Unlock()
+	notify(st.writeNotify)
+}
+
+func (st *Stream) remoteClose() {
+	st.mutex.Lock()
+	st.remoteClosed = true
+	st.mutex.Unlock()
+	notify(st.readNotify)
+	notify(st.writeNotify)
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.sess.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.sess.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	if err := st.SetReadDeadline(t); err != nil {
+		return err
+	}
+
+	return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mutex.Lock()
+	st.readDeadline = t
+	st.mutex.Unlock()
+	notify(st.readNotify)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mutex.Lock()
+	st.writeDeadline = t
+	st.mutex.Unlock()
+	notify(st.writeNotify)
+	return nil
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"egg/mux"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// MuxPool keeps a small number of long-lived multiplexed tunnels and opens
+// streams over them instead of dialing a new tunnel per connection
+type MuxPool struct {
+	size     int
+	dial     func() (net.Conn, error)
+	mutex    sync.Mutex
+	sessions []*mux.Session
+	// dialing holds a channel for every slot that is being dialed, it's
+	// closed once the dial is done
+	dialing []chan struct{}
+}
+
+func NewMuxPool(size int, dial func() (net.Conn, error)) *MuxPool {
+	return &MuxPool{
+		size:     size,
+		dial:     dial,
+		sessions: make([]*mux.Session, size),
+		dialing:  make([]chan struct{}, size),
+	}
+}
+
+// OpenStream opens a new stream over the least busy session, sessions that
+// are missing or closed are dialed again. dials run without holding the
+// lock, so a slow tunnel doesn't hold up streams over the others
+func (mp *MuxPool) OpenStream() (net.Conn, error) {
+	for {
+		mp.mutex.Lock()
+		best, empty := -1, -1
+		var wait chan struct{}
+		for i, sess := range mp.sessions {
+			if mp.dialing[i] != nil {
+				wait = mp.dialing[i]
+				continue
+			}
+			if sess == nil || sess.IsClosed() {
+				if empty == -1 {
+					empty = i
+				}
+				continue
+			}
+			if best == -1 || sess.NumStreams() < mp.sessions[best].NumStreams() {
+				best = i
+			}
+		}
+
+		switch {
+		case empty != -1:
+			// prefer filling an empty slot over sharing a busy session
+			done := make(chan struct{})
+			mp.dialing[empty] = done
+			mp.mutex.Unlock()
+			sess, err := mp.open(empty, done)
+			if err != nil {
+				return nil, err
+			}
+			return sess.OpenStream()
+		case best != -1:
+			sess := mp.sessions[best]
+			mp.mutex.Unlock()
+			return sess.OpenStream()
+		default:
+			// every slot is being dialed, wait for one of them and look again
+			mp.mutex.Unlock()
+			<-wait
+		}
+	}
+}
+
+// open dials the session of a slot reserved by OpenStream and releases it
+func (mp *MuxPool) open(slot int, done chan struct{}) (*mux.Session, error) {
+	defer close(done)
+	conn, err := mp.dial()
+
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	mp.dialing[slot] = nil
+	if err != nil {
+		return nil, err
+	}
+	sess := mux.Client(conn)
+	mp.sessions[slot] = sess
+	fmt.Printf("multiplexed tunnel %d established\n", slot)
+	return sess, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"egg/mux"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// muxPeer returns a tunnel whose other end accepts multiplexed streams
+func muxPeer(t *testing.T) net.Conn {
+	c1, c2 := net.Pipe()
+	server := mux.Server(c2)
+	t.Cleanup(func() { server.Close() })
+	go func() {
+		for {
+			if _, err := server.AcceptStream(); err != nil {
+				return
+			}
+		}
+	}()
+	return c1
+}
+
+func TestMuxPoolSlowDial(t *testing.T) {
+	hanging, release := make(chan struct{}), make(chan struct{})
+	var dials int32
+	pool := NewMuxPool(2, func() (net.Conn, error) {
+		if atomic.AddInt32(&dials, 1) == 2 {
+			// the second tunnel hangs until the end of the test
+			close(hanging)
+			<-release
+		}
+		return muxPeer(t), nil
+	})
+	defer close(release)
+
+	if _, err := pool.OpenStream(); err != nil {
+		t.Fatal(err)
+	}
+	go pool.OpenStream()
+	<-hanging
+
+	// the hanging dial of the second slot doesn't hold up the first
+	opened := make(chan error)
+	go func() {
+		for i := 0; i < 3; i++ {
+			if _, err := pool.OpenStream(); err != nil {
+				opened <- err
+				return
+			}
+		}
+		opened <- nil
+	}()
+	select {
+	case err := <-opened:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("opening a stream waited for another slot's dial")
+	}
+}
+
+func TestMuxPoolRedial(t *testing.T) {
+	var tunnels []net.Conn
+	pool := NewMuxPool(1, func() (net.Conn, error) {
+		conn := muxPeer(t)
+		tunnels = append(tunnels, conn)
+		return conn, nil
+	})
+
+	if _, err := pool.OpenStream(); err != nil {
+		t.Fatal(err)
+	}
+	tunnels[0].Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for !pool.sessions[0].IsClosed() {
+		if time.Now().After(deadline) {
+			t.Fatal("the session wasn't closed with its tunnel")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := pool.OpenStream(); err != nil {
+		t.Fatal(err)
+	}
+	if len(tunnels) != 2 {
+		t.Fatalf("%d tunnels were dialed instead of 2", len(tunnels))
+	}
+}
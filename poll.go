@@ -0,0 +1,688 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The polling transport carries tunnels over plain HTTP requests, for networks
+// that strip the Upgrade header. Every tunnel is a session with a random id:
+//
+//   - POST <path>/<session>/<seq> carries upstream data, seq 0 with an empty
+//     body opens the session. the server writes bodies to the tunnel in the
+//     order of their seq, whatever order they arrive in
+//   - GET <path>/<session>/<offset> is answered with downstream data as it
+//     becomes available, the response ends once it's idle for a moment, after
+//     pollDuration or after pollMaxResponse bytes and the client polls again.
+//     offset is the number of downstream bytes the client has received, the
+//     data after it that an earlier response carried is sent again, so a
+//     response dropped on the way loses nothing. once the tunnel has ended and
+//     all of its data is acknowledged, the answer is 204 No Content and the
+//     session is closed
+//   - DELETE <path>/<session> closes the session
+//
+// Requests for unknown sessions are handed to the fallback, which answers 404
+// like the decoy does, and a session that can't go on answers 410 Gone. The
+// client ends the tunnel with an error on either of them, other statuses are
+// taken for a failing hop in between and the request is sent again.
+const (
+	pollDuration     = 20 * time.Second
+	pollLinger       = 100 * time.Millisecond
+	pollMaxResponse  = 1024 * 1024
+	pollMaxBody      = 64 * 1024
+	pollMaxReorder   = 64
+	pollWriteTimeout = 30 * time.Second
+	pollSessionIdle  = 60 * time.Second
+	pollRetries      = 3
+)
+
+var (
+	ErrPollSessionClosed = errors.New("poll: session closed")
+	// errPollSessionLost is returned when the server no longer knows the session
+	errPollSessionLost = errors.New("poll: the server lost the session")
+)
+
+// pollRequest identifies a polling request from its path, seq is the offset
+// of a GET
+type pollRequest struct {
+	session string
+	seq     uint64
+}
+
+// parsePollRequest reports whether r is a polling request below tunnelPath
+func parsePollRequest(r *http.Request, tunnelPath string) (pollRequest, bool) {
+	rest := strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(tunnelPath, "/")+"/")
+	if rest == r.URL.Path {
+		return pollRequest{}, false
+	}
+	parts := strings.Split(rest, "/")
+	if !isSessionID(parts[0]) {
+		return pollRequest{}, false
+	}
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		return pollRequest{session: parts[0]}, true
+	case len(parts) == 2 && (r.Method == http.MethodPost || r.Method == http.MethodGet):
+		seq, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return pollRequest{}, false
+		}
+		return pollRequest{session: parts[0], seq: seq}, true
+	default:
+		return pollRequest{}, false
+	}
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func isSessionID(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == 16
+}
+
+// pollSession is the server side of a polling tunnel. the tunnel is one end
+// of a pipe and served like any other, the requests of the session read from
+// and write to the other end
+type pollSession struct {
+	id   string
+	peer net.Conn
+	cp   *ConnectionPool
+
+	mutex   sync.Mutex
+	turn    *sync.Cond
+	nextSeq uint64
+	// writing is set while the body of nextSeq is written to the tunnel
+	writing bool
+	closed  bool
+	idle    *time.Timer
+
+	// polling allows a single GET to read downstream data at a time, the
+	// fields below are guarded by it
+	polling sync.Mutex
+	// sent counts the downstream bytes read from the tunnel, unacked holds
+	// the last of them until the client acknowledges them
+	sent    uint64
+	unacked []byte
+	// ended is set once the tunnel has no more data
+	ended bool
+}
+
+// servePoll answers a polling request
+func (sf *Server) servePoll(w http.ResponseWriter, r *http.Request, q pollRequest, handle TunnelHandler) {
+	sess, found := sf.cp.GetPollSession(q.session)
+	if !found {
+		if r.Method != http.MethodPost || q.seq != 0 {
+			sf.fallback.ServeHTTP(w, r)
+			return
+		}
+		var err error
+		if sess, err = sf.openPollSession(q.session, handle); err != nil {
+			sf.fallback.ServeHTTP(w, r)
+			return
+		}
+	}
+	sess.touch()
+	defer sess.touch()
+
+	switch r.Method {
+	case http.MethodGet:
+		sess.pull(r.Context(), w, q.seq)
+	case http.MethodDelete:
+		sess.close()
+	case http.MethodPost:
+		body, err := io.ReadAll(io.LimitReader(r.Body, pollMaxBody+1))
+		if err != nil {
+			return
+		}
+		if len(body) > pollMaxBody {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err := sess.push(q.seq, body); err != nil {
+			fmt.Printf("poll session %s: %v\n", sess.id, err)
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+	}
+}
+
+func (sf *Server) openPollSession(id string, handle TunnelHandler) (*pollSession, error) {
+	tunnel, peer := net.Pipe()
+	sess := &pollSession{
+		id:   id,
+		peer: peer,
+		cp:   sf.cp,
+	}
+	sess.turn = sync.NewCond(&sess.mutex)
+	// seq 0 opens the session
+	sess.nextSeq = 1
+	sess.idle = time.AfterFunc(pollSessionIdle, sess.close)
+	if err := sf.cp.NewPollSession(id, sess); err != nil {
+		// another request opened it first
+		sess.idle.Stop()
+		return nil, err
+	}
+
+	go func() {
+		handle(tunnel)
+		// the session lasts until the client has received the rest of the
+		// data, or until it's idle
+		tunnel.Close()
+	}()
+	return sess, nil
+}
+
+// push writes the body of the POST numbered seq to the tunnel once all the
+// bodies before it have been written
+func (s *pollSession) push(seq uint64, body []byte) error {
+	s.mutex.Lock()
+	if seq > s.nextSeq+pollMaxReorder {
+		s.mutex.Unlock()
+		return fmt.Errorf("seq %d is too far ahead of %d", seq, s.nextSeq)
+	}
+	for !s.closed && (seq > s.nextSeq || seq == s.nextSeq && s.writing) {
+		s.turn.Wait()
+	}
+	if s.closed {
+		s.mutex.Unlock()
+		return ErrPollSessionClosed
+	}
+	if seq < s.nextSeq {
+		// a retransmission of a body that's been written already
+		s.mutex.Unlock()
+		return nil
+	}
+	s.writing = true
+	s.mutex.Unlock()
+
+	var err error
+	if len(body) > 0 {
+		_ = s.peer.SetWriteDeadline(time.Now().Add(pollWriteTimeout))
+		_, err = s.peer.Write(body)
+	}
+
+	s.mutex.Lock()
+	s.writing = false
+	if err == nil {
+		s.nextSeq++
+	}
+	s.turn.Broadcast()
+	s.mutex.Unlock()
+
+	if err != nil {
+		s.close()
+	}
+	return err
+}
+
+// pull streams downstream data to w until the tunnel is idle for a moment,
+// the poll times out, the response is large enough or the client goes away.
+// acked is the offset the client has received, what was sent after it is
+// sent again first
+func (s *pollSession) pull(ctx context.Context, w http.ResponseWriter, acked uint64) {
+	s.polling.Lock()
+	defer s.polling.Unlock()
+
+	base := s.sent - uint64(len(s.unacked))
+	if acked < base || acked > s.sent {
+		fmt.Printf("poll session %s: offset %d is out of %d-%d\n", s.id, acked, base, s.sent)
+		w.WriteHeader(http.StatusGone)
+		s.close()
+		return
+	}
+	s.unacked = s.unacked[acked-base:]
+	if s.ended && len(s.unacked) == 0 {
+		// the client has everything, the tunnel ends cleanly
+		w.WriteHeader(http.StatusNoContent)
+		s.close()
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if len(s.unacked) > 0 {
+		if _, err := w.Write(s.unacked); err != nil {
+			return
+		}
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+	if s.ended {
+		return
+	}
+
+	// a poll the client gives up on stops reading the tunnel right away, the
+	// deadline is set under a lock so that it can't undo the one of the cancel
+	var deadlineMutex sync.Mutex
+	setDeadline := func(t time.Time) {
+		deadlineMutex.Lock()
+		defer deadlineMutex.Unlock()
+		if ctx.Err() != nil {
+			t = time.Now()
+		}
+		_ = s.peer.SetReadDeadline(t)
+	}
+	stop := context.AfterFunc(ctx, func() { setDeadline(time.Now()) })
+	defer stop()
+
+	buf := BufferPool.Get()
+	defer BufferPool.Put(buf)
+
+	end := time.Now().Add(pollDuration)
+	deadline := end
+	for sent := len(s.unacked); sent < pollMaxResponse; {
+		setDeadline(deadline)
+		n, err := s.peer.Read(buf[:cap(buf)])
+		if n > 0 {
+			s.unacked = append(s.unacked, buf[:n]...)
+			s.sent += uint64(n)
+			if _, err := w.Write(buf[:n]); err != nil {
+				// the client asks for the data again with its next poll
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			sent += n
+			if linger := time.Now().Add(pollLinger); linger.Before(end) {
+				deadline = linger
+			}
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return
+		}
+		if err != nil {
+			// the tunnel ended, the session is closed once the client
+			// has acknowledged the rest of the data
+			s.ended = true
+			return
+		}
+	}
+}
+
+func (s *pollSession) touch() {
+	s.idle.Reset(pollSessionIdle)
+}
+
+func (s *pollSession) close() {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return
+	}
+	s.closed = true
+	s.turn.Broadcast()
+	s.mutex.Unlock()
+
+	s.idle.Stop()
+	s.peer.Close()
+	s.cp.RmPollSession(s.id)
+}
+
+// PollDialer opens polling tunnels, polls:// endpoints use TLS and poll://
+// endpoints plain HTTP. random paths aren't supported by the transport, a
+// random query is added to every request when randomization is enabled
+type PollDialer struct {
+	*DialSettings
+
+	client *http.Client
+}
+
+func NewPollDialer(s *DialSettings) *PollDialer {
+	d := &PollDialer{DialSettings: s}
+	d.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return d.dialTCP(ctx, network, addr)
+			},
+			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return d.dialTLS(ctx, network, addr, wsALPN)
+			},
+			MaxIdleConnsPerHost:   4,
+			IdleConnTimeout:       90 * time.Second,
+			ResponseHeaderTimeout: pollWriteTimeout + HandshakeTimeout,
+		},
+		// a redirect means the request reached something else than the server
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return d
+}
+
+// Dial opens a polling session, it returns once the server has accepted it
+func (d *PollDialer) Dial(pathType PathType) (net.Conn, error) {
+	base, err := url.Parse(d.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme == "poll" {
+		base.Scheme = "http"
+	} else {
+		base.Scheme = "https"
+	}
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/") + "/" + id
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, writer := io.Pipe()
+	c := &pollConn{
+		dialer:   d,
+		client:   d.client,
+		base:     base,
+		ctx:      ctx,
+		cancel:   cancel,
+		outbound: make(chan []byte, 16),
+		reader:   reader,
+		writer:   writer,
+	}
+
+	openCtx, openCancel := context.WithTimeout(ctx, HandshakeTimeout)
+	defer openCancel()
+	if err := c.post(openCtx, 0, nil); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	go c.sendLoop()
+	go c.pollLoop()
+	return c, nil
+}
+
+// pollConn is the client side of a polling tunnel as a net.Conn, an expired
+// deadline closes the whole tunnel instead of failing only the pending operation
+type pollConn struct {
+	dialer *PollDialer
+	client *http.Client
+	base   *url.URL
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// outbound queues upstream data for the send loop
+	outbound chan []byte
+	// the poll loop writes downstream data to the pipe
+	reader *io.PipeReader
+	writer *io.PipeWriter
+
+	closeOnce  sync.Once
+	timerMutex sync.Mutex
+	readTimer  *time.Timer
+	writeTimer *time.Timer
+}
+
+func (c *pollConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *pollConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n := len(b) - written
+		if n > pollMaxBody {
+			n = pollMaxBody
+		}
+		chunk := append([]byte(nil), b[written:written+n]...)
+		select {
+		case c.outbound <- chunk:
+			written += n
+		case <-c.ctx.Done():
+			return written, ErrPollSessionClosed
+		}
+	}
+	return written, nil
+}
+
+// sendLoop posts the queued upstream data, whatever is queued by the time a
+// request is sent goes into the same body
+func (c *pollConn) sendLoop() {
+	// carry is a chunk that didn't fit into the previous body
+	var carry []byte
+	for seq := uint64(1); ; seq++ {
+		body := carry
+		carry = nil
+		if body == nil {
+			select {
+			case body = <-c.outbound:
+			case <-c.ctx.Done():
+				return
+			}
+		}
+	batch:
+		for len(body) < pollMaxBody {
+			select {
+			case chunk := <-c.outbound:
+				if len(body)+len(chunk) > pollMaxBody {
+					carry = chunk
+					break batch
+				}
+				body = append(body, chunk...)
+			default:
+				break batch
+			}
+		}
+
+		var err error
+		for attempt := 0; attempt < pollRetries; attempt++ {
+			if err = c.post(c.ctx, seq, body); err == nil || c.ctx.Err() != nil {
+				break
+			}
+			time.Sleep(time.Duration(attempt+1) * 500 * time.Millisecond)
+		}
+		if err != nil {
+			if c.ctx.Err() == nil {
+				fmt.Println("poll error:", err)
+			}
+			c.writer.CloseWithError(err)
+			c.release()
+			return
+		}
+	}
+}
+
+// pollLoop polls downstream data until the session ends, a poll that fails
+// is sent again and the server resends what the client has missed
+func (c *pollConn) pollLoop() {
+	var received uint64
+	failures := 0
+	for {
+		n, ended, err := c.poll(received)
+		received += n
+		if ended {
+			c.writer.Close()
+			c.release()
+			return
+		}
+		if err == nil || n > 0 {
+			failures = 0
+		}
+		if err == nil {
+			continue
+		}
+		failures++
+		if c.ctx.Err() != nil || failures > pollRetries || errors.Is(err, errPollSessionLost) {
+			c.writer.CloseWithError(err)
+			c.release()
+			return
+		}
+		time.Sleep(time.Duration(failures) * 500 * time.Millisecond)
+	}
+}
+
+// poll sends a single GET that acknowledges the received bytes, it returns
+// the number of bytes it has added and whether the tunnel has ended
+func (c *pollConn) poll(received uint64) (uint64, bool, error) {
+	req, err := c.request(c.ctx, http.MethodGet, c.base.String()+"/"+strconv.FormatUint(received, 10), nil)
+	if err != nil {
+		return 0, false, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent:
+		return 0, true, nil
+	case http.StatusNotFound, http.StatusGone:
+		return 0, false, errPollSessionLost
+	default:
+		return 0, false, fmt.Errorf("poll: unexpected status %s", resp.Status)
+	}
+	n, err := io.Copy(c.writer, resp.Body)
+	return uint64(n), false, err
+}
+
+func (c *pollConn) post(ctx context.Context, seq uint64, body []byte) error {
+	req, err := c.request(ctx, http.MethodPost, c.base.String()+"/"+strconv.FormatUint(seq, 10), body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("poll: unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// request builds a request of the session with the dialer's headers
+func (c *pollConn) request(ctx context.Context, method string, target string, body []byte) (*http.Request, error) {
+	if c.dialer.fronting.Randomize == "query" {
+		u, _ := url.Parse(target)
+		q := u.Query()
+		q.Set(queryKeys[mrand.Intn(len(queryKeys))], randomToken(6+mrand.Intn(10)))
+		u.RawQuery = q.Encode()
+		target = u.String()
+	}
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, r)
+	if err != nil {
+		return nil, err
+	}
+	header, err := c.dialer.requestHeader()
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header.Clone()
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+		req.Header.Del("Host")
+	}
+	return req, nil
+}
+
+func (c *pollConn) Close() error {
+	c.reader.Close()
+	c.release()
+	return nil
+}
+
+// release stops the loops and lets the server release the session, reads
+// still get the data and the error the poll loop has ended the pipe with
+func (c *pollConn) release() {
+	c.closeOnce.Do(func() {
+		c.cancel()
+
+		c.timerMutex.Lock()
+		stopTimer(c.readTimer)
+		stopTimer(c.writeTimer)
+		c.timerMutex.Unlock()
+
+		// let the server release the session right away
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), HandshakeTimeout)
+			defer cancel()
+			req, err := c.request(ctx, http.MethodDelete, c.base.String(), nil)
+			if err != nil {
+				return
+			}
+			if resp, err := c.client.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}()
+	})
+}
+
+func (c *pollConn) LocalAddr() net.Addr {
+	return pollAddr{}
+}
+
+func (c *pollConn) RemoteAddr() net.Addr {
+	return pollAddr{}
+}
+
+func (c *pollConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+
+	return c.SetWriteDeadline(t)
+}
+
+func (c *pollConn) SetReadDeadline(t time.Time) error {
+	c.timerMutex.Lock()
+	defer c.timerMutex.Unlock()
+	c.readTimer = c.resetTimer(c.readTimer, t)
+	return nil
+}
+
+func (c *pollConn) SetWriteDeadline(t time.Time) error {
+	c.timerMutex.Lock()
+	defer c.timerMutex.Unlock()
+	c.writeTimer = c.resetTimer(c.writeTimer, t)
+	return nil
+}
+
+func (c *pollConn) resetTimer(timer *time.Timer, t time.Time) *time.Timer {
+	stopTimer(timer)
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), func() { c.Close() })
+}
+
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+// pollAddr is the address of both ends of a polling tunnel
+type pollAddr struct{}
+
+func (pollAddr) Network() string { return "poll" }
+func (pollAddr) String() string  { return "poll" }
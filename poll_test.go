@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// pollServer serves polling tunnels with handle, every request goes through
+// intercept first when it isn't nil, which reports whether it has answered it.
+// next is the handler of the server
+func pollServer(t *testing.T, handle TunnelHandler, intercept func(w http.ResponseWriter, r *http.Request, next http.Handler) bool) *httptest.Server {
+	sf, err := NewServer(ServerConfig{Path: "/ws"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := sf.NewHTTPTransport("", nil).handler(handle)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if intercept != nil && intercept(w, r, handler) {
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func dialPoll(t *testing.T, ts *httptest.Server) net.Conn {
+	endpoint := "poll://" + strings.TrimPrefix(ts.URL, "http://") + "/ws"
+	settings, err := NewDialSettings(endpoint, FrontingOptions{}, &tls.Config{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := NewPollDialer(settings).Dial(TwoWay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// sendAndClose is a tunnel handler that sends data and ends the tunnel
+func sendAndClose(data []byte) TunnelHandler {
+	return func(conn net.Conn) {
+		conn.Write(data)
+		conn.Close()
+	}
+}
+
+// every counts the GETs of a test, it's true for every n-th of them
+func every(n int64) func(r *http.Request) bool {
+	var gets int64
+	return func(r *http.Request) bool {
+		return r.Method == http.MethodGet && atomic.AddInt64(&gets, 1)%n == 0
+	}
+}
+
+// pollSend sends a single request of session id and returns the status and
+// the body of the answer
+func pollSend(t *testing.T, ts *httptest.Server, method, id, path, body string) (int, string) {
+	req, err := http.NewRequest(method, ts.URL+"/ws/"+id+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func pollData(t *testing.T, size int) []byte {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestPollTransientStatus(t *testing.T) {
+	data := pollData(t, 3*pollMaxResponse)
+	// a hop in between fails every other poll
+	failing := every(2)
+	ts := pollServer(t, sendAndClose(data), func(w http.ResponseWriter, r *http.Request, _ http.Handler) bool {
+		if failing(r) {
+			w.WriteHeader(http.StatusBadGateway)
+			return true
+		}
+		return false
+	})
+
+	out, err := io.ReadAll(dialPoll(t, ts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatalf("received %d bytes that differ from the %d sent", len(out), len(data))
+	}
+}
+
+func TestPollRetriesRunOut(t *testing.T) {
+	ts := pollServer(t, sendAndClose([]byte("hello")), func(w http.ResponseWriter, r *http.Request, _ http.Handler) bool {
+		if r.Method == http.MethodGet {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return true
+		}
+		return false
+	})
+
+	_, err := io.ReadAll(dialPoll(t, ts))
+	if err == nil {
+		t.Fatal("the tunnel ended cleanly although no poll went through")
+	}
+}
+
+func TestPollSessionLost(t *testing.T) {
+	// the session is lost after the first poll
+	var gets int64
+	ts := pollServer(t, func(conn net.Conn) {
+		conn.Write([]byte("hello"))
+		conn.Read(make([]byte, 1))
+	}, func(w http.ResponseWriter, r *http.Request, _ http.Handler) bool {
+		if r.Method == http.MethodGet && atomic.AddInt64(&gets, 1) > 1 {
+			http.NotFound(w, r)
+			return true
+		}
+		return false
+	})
+
+	out, err := io.ReadAll(dialPoll(t, ts))
+	if string(out) != "hello" || !errors.Is(err, errPollSessionLost) {
+		t.Fatalf("read %q, %v instead of the data and errPollSessionLost", out, err)
+	}
+}
+
+func TestPollReorderedPosts(t *testing.T) {
+	// the tunnel echoes what it receives
+	ts := pollServer(t, func(conn net.Conn) {
+		b := make([]byte, 6)
+		if _, err := io.ReadFull(conn, b); err == nil {
+			conn.Write(b)
+		}
+		conn.Close()
+	}, nil)
+	id, _ := newSessionID()
+	if status, _ := pollSend(t, ts, http.MethodPost, id, "/0", ""); status != http.StatusOK {
+		t.Fatalf("opening the session answered %d", status)
+	}
+
+	// the later bodies arrive first and wait for the ones before them
+	statuses := make(chan int, 2)
+	for seq, body := range map[string]string{"/3": "ef", "/2": "cd"} {
+		go func(seq, body string) {
+			status, _ := pollSend(t, ts, http.MethodPost, id, seq, body)
+			statuses <- status
+		}(seq, body)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if status, _ := pollSend(t, ts, http.MethodPost, id, "/1", "ab"); status != http.StatusOK {
+		t.Fatalf("seq 1 answered %d", status)
+	}
+	for i := 0; i < 2; i++ {
+		if status := <-statuses; status != http.StatusOK {
+			t.Fatalf("a reordered body answered %d", status)
+		}
+	}
+	// a retransmission isn't written again
+	if status, _ := pollSend(t, ts, http.MethodPost, id, "/2", "cd"); status != http.StatusOK {
+		t.Fatalf("a retransmission answered %d", status)
+	}
+
+	if _, out := pollSend(t, ts, http.MethodGet, id, "/0", ""); out != "abcdef" {
+		t.Fatalf("the tunnel received %q", out)
+	}
+}
+
+func TestPollTooFarAhead(t *testing.T) {
+	ts := pollServer(t, func(conn net.Conn) { io.Copy(io.Discard, conn) }, nil)
+	id, _ := newSessionID()
+	pollSend(t, ts, http.MethodPost, id, "/0", "")
+	if status, _ := pollSend(t, ts, http.MethodPost, id, fmt.Sprintf("/%d", pollMaxReorder+2), "x"); status != http.StatusGone {
+		t.Fatalf("a body too far ahead answered %d instead of 410", status)
+	}
+}
+
+func TestPollResend(t *testing.T) {
+	ts := pollServer(t, sendAndClose([]byte("hello world")), nil)
+	id, _ := newSessionID()
+	pollSend(t, ts, http.MethodPost, id, "/0", "")
+
+	// the data of a poll the client didn't acknowledge is sent again
+	for _, tt := range []struct {
+		offset string
+		status int
+		data   string
+	}{
+		{"/0", http.StatusOK, "hello world"},
+		{"/0", http.StatusOK, "hello world"},
+		{"/6", http.StatusOK, "world"},
+		{"/12", http.StatusGone, ""},
+	} {
+		status, data := pollSend(t, ts, http.MethodGet, id, tt.offset, "")
+		if status != tt.status || data != tt.data {
+			t.Fatalf("GET %s answered %d %q instead of %d %q", tt.offset, status, data, tt.status, tt.data)
+		}
+	}
+
+	ts = pollServer(t, sendAndClose([]byte("hello world")), nil)
+	id, _ = newSessionID()
+	pollSend(t, ts, http.MethodPost, id, "/0", "")
+	pollSend(t, ts, http.MethodGet, id, "/0", "")
+	if status, _ := pollSend(t, ts, http.MethodGet, id, "/11", ""); status != http.StatusNoContent {
+		t.Fatalf("the end of the tunnel answered %d instead of 204", status)
+	}
+	if status, _ := pollSend(t, ts, http.MethodGet, id, "/11", ""); status != http.StatusNotFound {
+		t.Fatalf("a closed session answered %d instead of 404", status)
+	}
+}
+
+func TestPollDroppedResponse(t *testing.T) {
+	data := pollData(t, 3*pollMaxResponse)
+	// a hop in between loses the response of every other poll after the
+	// server has sent it
+	dropping := every(2)
+	ts := pollServer(t, sendAndClose(data), func(w http.ResponseWriter, r *http.Request, next http.Handler) bool {
+		if dropping(r) {
+			next.ServeHTTP(httptest.NewRecorder(), r)
+			w.WriteHeader(http.StatusBadGateway)
+			return true
+		}
+		return false
+	})
+
+	out, err := io.ReadAll(dialPoll(t, ts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatalf("received %d bytes that differ from the %d sent", len(out), len(data))
+	}
+}
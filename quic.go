@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"egg/quicconn"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// quicALPN is what QUIC tunnels negotiate, it's the protocol of HTTP/3 so
+// that the handshake looks like one
+var quicALPN = []string{"h3"}
+
+func newQUICConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout: HandshakeTimeout,
+		MaxIdleTimeout:       60 * time.Second,
+		KeepAlivePeriod:      15 * time.Second,
+		MaxIncomingStreams:   1024,
+		EnableDatagrams:      true,
+	}
+}
+
+// enableDatagrams switches a UDP tunnel to QUIC datagrams, if it's a plain QUIC stream
+func enableDatagrams(conn net.Conn) {
+	switch c := conn.(type) {
+	case *quicconn.Conn:
+		c.EnableDatagrams()
+	case *bufferedConn:
+		enableDatagrams(c.Conn)
+	case *trackedConn:
+		enableDatagrams(c.Conn)
+	}
+}
+
+// QUICDialer opens tunnels as streams of a QUIC connection, quic:// endpoints
+// select it. The handshake can't be fingerprinted or sent without a server name
+type QUICDialer struct {
+	*DialSettings
+
+	mutex sync.Mutex
+	sess  *quicconn.Session
+}
+
+func NewQUICDialer(s *DialSettings) (*QUICDialer, error) {
+	if s.fronting.OmitSNI {
+		return nil, errors.New("quic tunnels can't omit the server name")
+	}
+	if s.relays != nil {
+		return nil, errors.New("quic tunnels can't go through tcp relays")
+	}
+	return &QUICDialer{DialSettings: s}, nil
+}
+
+// session returns the QUIC connection of the dialer, it's dialed again once it's closed
+func (d *QUICDialer) session() (*quicconn.Session, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.sess != nil && !d.sess.IsClosed() {
+		return d.sess, nil
+	}
+
+	u, err := url.Parse(d.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	port := u.Port()
+	if port == "" {
+		port = portMap["https"]
+	}
+	host, port, err := net.SplitHostPort(d.connectAddr(net.JoinHostPort(u.Hostname(), port)))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DialTimeout+HandshakeTimeout)
+	defer cancel()
+	ips, err := dnsResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	raddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(ips[0].String(), port))
+	if err != nil {
+		return nil, err
+	}
+
+	packetConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	config := stdTLSConfig(d.clientTLSConfig(u.Hostname()))
+	config.NextProtos = quicALPN
+	conn, err := quic.Dial(ctx, packetConn, raddr, config, newQUICConfig())
+	if err != nil {
+		packetConn.Close()
+		return nil, err
+	}
+	go func() {
+		// the socket isn't owned by the connection
+		<-conn.Context().Done()
+		packetConn.Close()
+	}()
+
+	d.sess = quicconn.NewSession(conn)
+	return d.sess, nil
+}
+
+// Dial opens a stream for a tunnel
+func (d *QUICDialer) Dial(pathType PathType) (net.Conn, error) {
+	sess, err := d.session()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), HandshakeTimeout)
+	defer cancel()
+	return sess.OpenStream(ctx)
+}
+
+// ListenAndServeQUIC serves QUIC tunnels on UDP
+func (sf *Server) ListenAndServeQUIC(addr string, tlsConfig *tls.Config) error {
+	t, err := NewQUICTransport(addr, tlsConfig)
+	if err != nil {
+		return err
+	}
+	return sf.Serve(t)
+}
+
+// QUICTransport accepts QUIC connections, every stream is a tunnel
+type QUICTransport struct {
+	addr   string
+	config *tls.Config
+
+	mutex sync.Mutex
+	ln    *quic.Listener
+}
+
+func NewQUICTransport(addr string, tlsConfig *tls.Config) (*QUICTransport, error) {
+	if tlsConfig == nil {
+		return nil, errors.New("quic needs tls to be configured")
+	}
+	config := tlsConfig.Clone()
+	config.NextProtos = quicALPN
+	return &QUICTransport{
+		addr:   addr,
+		config: config,
+	}, nil
+}
+
+func (t *QUICTransport) Serve(handle TunnelHandler) error {
+	ln, err := quic.ListenAddr(t.addr, t.config, newQUICConfig())
+	if err != nil {
+		return err
+	}
+	t.mutex.Lock()
+	t.ln = ln
+	t.mutex.Unlock()
+
+	fmt.Printf("Serving QUIC at %s ...\n", t.addr)
+	for {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+		go serveQUIC(conn, handle)
+	}
+}
+
+func (t *QUICTransport) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.ln == nil {
+		return nil
+	}
+	return t.ln.Close()
+}
+
+func serveQUIC(conn quic.Connection, handle TunnelHandler) {
+	sess := quicconn.NewSession(conn)
+	defer sess.Close()
+	for {
+		stream, err := sess.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go handle(stream)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	stdtls "crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// freeUDPAddr returns a loopback address with a UDP port that's free right now
+func freeUDPAddr(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+// udpEcho returns the address of a UDP socket that sends every datagram back
+func udpEcho(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// quicUpstream serves QUIC tunnels on loopback and returns an upstream of a
+// client dialing them
+func quicUpstream(t *testing.T) *upstream {
+	cert, err := selfSignedCertificate(ServerTLSOptions{SelfSigned: true, Hosts: []string{"127.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf, err := NewServer(ServerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := freeUDPAddr(t)
+	transport, err := NewQUICTransport(addr, &stdtls.Config{Certificates: []stdtls.Certificate{*cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sf.Serve(transport)
+	t.Cleanup(func() { transport.Close() })
+
+	endpoint := "quic://" + addr + "/ws"
+	settings, err := NewDialSettings(endpoint, FrontingOptions{}, &tls.Config{InsecureSkipVerify: true}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := NewQUICDialer(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &upstream{
+		endpoint:   endpoint,
+		transports: map[PathType]Transport{TwoWay: dialer},
+	}
+}
+
+func TestQUICDatagrams(t *testing.T) {
+	u := quicUpstream(t)
+	c := &Client{}
+
+	conn, err := c.handshake(u, &PathReq{Id: "udp", Dest: udpEcho(t), Net: UDP, PType: TwoWay}, time.Now().Add(10*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// like wsClient, both ends switch to datagrams after the handshake
+	enableDatagrams(conn)
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for _, msg := range []string{"hello", "world"} {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 2048)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("no echo of %q: %v", msg, err)
+		}
+		if string(buf[:n]) != msg {
+			t.Fatalf("received %q instead of %q", buf[:n], msg)
+		}
+	}
+}
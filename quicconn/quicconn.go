@@ -0,0 +1,262 @@
+package quicconn
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// adapters for representing the streams of a QUIC connection as net.Conns.
+// A stream can switch to datagrams for UDP traffic, then every write is sent
+// as a QUIC datagram prefixed with the stream id as a varint, and datagrams
+// are dispatched to their stream by that id. Writes too large for a datagram
+// still go over the stream, and closing the stream ends the flow
+
+// maxQueuedDatagrams is how many datagrams a stream buffers before it drops them
+const maxQueuedDatagrams = 128
+
+var ErrClosed = errors.New("quicconn: session closed")
+
+// Session tracks the streams of a QUIC connection so that datagrams can be
+// dispatched to them
+type Session struct {
+	conn quic.Connection
+
+	mutex sync.Mutex
+	flows map[quic.StreamID]*Conn
+}
+
+// NewSession wraps conn, it starts receiving datagrams if the peer supports them
+func NewSession(conn quic.Connection) *Session {
+	s := &Session{
+		conn:  conn,
+		flows: make(map[quic.StreamID]*Conn),
+	}
+	if conn.ConnectionState().SupportsDatagrams {
+		go s.receiveDatagrams()
+	}
+	return s
+}
+
+func (s *Session) OpenStream(ctx context.Context) (*Conn, error) {
+	stream, err := s.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.register(stream), nil
+}
+
+func (s *Session) AcceptStream(ctx context.Context) (*Conn, error) {
+	stream, err := s.conn.AcceptStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.register(stream), nil
+}
+
+// IsClosed reports whether the QUIC connection is gone
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.conn.Context().Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// NumStreams returns the number of open streams
+func (s *Session) NumStreams() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.flows)
+}
+
+func (s *Session) Close() error {
+	return s.conn.CloseWithError(0, "")
+}
+
+func (s *Session) register(stream quic.Stream) *Conn {
+	c := &Conn{
+		session:   s,
+		stream:    stream,
+		datagrams: make(chan []byte, maxQueuedDatagrams),
+		done:      make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
+	s.mutex.Lock()
+	s.flows[stream.StreamID()] = c
+	s.mutex.Unlock()
+	return c
+}
+
+func (s *Session) unregister(id quic.StreamID) {
+	s.mutex.Lock()
+	delete(s.flows, id)
+	s.mutex.Unlock()
+}
+
+func (s *Session) receiveDatagrams() {
+	for {
+		msg, err := s.conn.ReceiveDatagram(context.Background())
+		if err != nil {
+			return
+		}
+		r := bytes.NewReader(msg)
+		id, err := quicvarint.Read(r)
+		if err != nil {
+			continue
+		}
+		s.mutex.Lock()
+		c, ok := s.flows[quic.StreamID(id)]
+		s.mutex.Unlock()
+		if !ok {
+			continue
+		}
+		select {
+		case c.datagrams <- msg[len(msg)-r.Len():]:
+		default:
+			// like UDP, datagrams are dropped when the reader can't keep up
+		}
+	}
+}
+
+// Conn is a QUIC stream as a net.Conn
+type Conn struct {
+	session *Session
+	stream  quic.Stream
+
+	readMutex sync.Mutex
+	// pending is the rest of a datagram that didn't fit into the last read
+	pending []byte
+
+	datagramMutex sync.Mutex
+	useDatagrams  bool
+	// datagrams receives the datagrams of the stream, and once datagrams are
+	// enabled the writes that went over the stream too
+	datagrams chan []byte
+	// done is closed once the stream can't be read anymore, readErr tells why
+	done    chan struct{}
+	readErr error
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// EnableDatagrams switches the stream to datagrams, it's a no-op when the
+// peer doesn't support them. Both peers switch at the same point of their
+// conversation, datagrams that arrive earlier are queued. Read deadlines only
+// apply to reads from the stream, so they should be cleared before switching
+func (c *Conn) EnableDatagrams() {
+	if !c.session.conn.ConnectionState().SupportsDatagrams {
+		return
+	}
+	c.datagramMutex.Lock()
+	defer c.datagramMutex.Unlock()
+	if c.useDatagrams {
+		return
+	}
+	c.useDatagrams = true
+	go c.readStream()
+}
+
+// readStream forwards writes the peer sent over the stream, they were too
+// large for a datagram
+func (c *Conn) readStream() {
+	defer close(c.done)
+	for {
+		buf := make([]byte, 64*1024)
+		n, err := c.stream.Read(buf)
+		if n > 0 {
+			select {
+			case c.datagrams <- buf[:n]:
+			case <-c.closed:
+				return
+			}
+		}
+		if err != nil {
+			c.readErr = err
+			return
+		}
+	}
+}
+
+func (c *Conn) datagramMode() bool {
+	c.datagramMutex.Lock()
+	defer c.datagramMutex.Unlock()
+	return c.useDatagrams
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if !c.datagramMode() {
+		return c.stream.Read(b)
+	}
+
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+	if len(c.pending) == 0 {
+		select {
+		case c.pending = <-c.datagrams:
+		case <-c.done:
+			// whatever has been queued is still delivered
+			select {
+			case c.pending = <-c.datagrams:
+			default:
+				return 0, c.readErr
+			}
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.datagramMode() {
+		msg := quicvarint.Append(make([]byte, 0, 8+len(b)), uint64(c.stream.StreamID()))
+		msg = append(msg, b...)
+		err := c.session.conn.SendDatagram(msg)
+		if err == nil {
+			return len(b), nil
+		}
+		if !errors.Is(err, &quic.DatagramTooLargeError{}) {
+			return 0, err
+		}
+	}
+	return c.stream.Write(b)
+}
+
+// Close closes both directions of the stream
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.session.unregister(c.stream.StreamID())
+		c.stream.CancelRead(0)
+	})
+	return c.stream.Close()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.session.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.session.conn.RemoteAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.stream.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.stream.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.stream.SetWriteDeadline(t)
+}
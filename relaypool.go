@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// relay rotation modes, they decide when a relay pool moves on to its next relay
+const (
+	RotatePerConnection = "connection"
+	RotateOnFailure     = "failure"
+)
+
+// RelayOptions controls how the relays of an endpoint are used
+type RelayOptions struct {
+	// Rotate is RotatePerConnection or RotateOnFailure
+	Rotate string
+	// Blacklist is how long a relay that failed to connect is skipped
+	Blacklist time.Duration
+	// ReportInterval is how often the health of the relays is logged, 0 disables it
+	ReportInterval time.Duration
+}
+
+// RelayPool spreads the tunnels of an endpoint over relays forwarding to the
+// server, so that a blocked relay doesn't take the path down. relays that
+// fail to connect are blacklisted for a while, unless all of them are
+type RelayPool struct {
+	name string
+	opts RelayOptions
+
+	mutex  sync.Mutex
+	relays []*relay
+	// current is the index of the relay the last dial went through
+	current int
+}
+
+type relay struct {
+	addr     string
+	dials    int
+	failures int
+	// failedUntil is when the relay leaves the blacklist
+	failedUntil time.Time
+	lastErr     error
+}
+
+// NewRelayPool returns a pool of the relays of an endpoint, name is what its
+// logs refer to
+func NewRelayPool(name string, addrs []string, opts RelayOptions) (*RelayPool, error) {
+	switch opts.Rotate {
+	case RotatePerConnection, RotateOnFailure:
+	default:
+		return nil, fmt.Errorf("unknown relay rotation %q", opts.Rotate)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no relays for %s", name)
+	}
+	p := &RelayPool{
+		name: name,
+		opts: opts,
+	}
+	if opts.Rotate == RotatePerConnection {
+		// the first dial moves on to the first relay
+		p.current = len(addrs) - 1
+	}
+	for _, addr := range addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid relay address %q, it should look like <ip>:<port>", addr)
+		}
+		p.relays = append(p.relays, &relay{addr: addr})
+	}
+	if opts.ReportInterval > 0 {
+		go p.reportLoop()
+	}
+	return p, nil
+}
+
+// Pick returns the relay of the next dial, it's the current one unless the
+// pool rotates per connection or the current one is blacklisted
+func (p *RelayPool) Pick() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n := len(p.relays)
+	start := p.current
+	if p.opts.Rotate == RotatePerConnection {
+		start = (start + 1) % n
+	}
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		if r := p.relays[(start+i)%n]; !now.Before(r.failedUntil) {
+			p.current = (start + i) % n
+			return r.addr
+		}
+	}
+
+	// every relay is blacklisted, the one that leaves the blacklist first is tried
+	best := start
+	for i, r := range p.relays {
+		if r.failedUntil.Before(p.relays[best].failedUntil) {
+			best = i
+		}
+	}
+	p.current = best
+	return p.relays[best].addr
+}
+
+// Report records the outcome of a dial through addr, a failed relay is
+// blacklisted
+func (p *RelayPool) Report(addr string, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var r *relay
+	for _, v := range p.relays {
+		if v.addr == addr {
+			r = v
+		}
+	}
+	if r == nil {
+		return
+	}
+	r.dials++
+	if err == nil {
+		if r.lastErr != nil {
+			fmt.Printf("relay %s of %s is reachable again\n", r.addr, p.name)
+		}
+		r.lastErr = nil
+		r.failedUntil = time.Time{}
+		return
+	}
+	r.failures++
+	r.lastErr = err
+	r.failedUntil = time.Now().Add(p.opts.Blacklist)
+	fmt.Printf("relay %s of %s blacklisted for %v: %v\n", r.addr, p.name, p.opts.Blacklist, err)
+}
+
+// summary describes the health of every relay
+func (p *RelayPool) summary() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	parts := make([]string, 0, len(p.relays))
+	for _, r := range p.relays {
+		state := "ok"
+		if now.Before(r.failedUntil) {
+			state = fmt.Sprintf("blacklisted for %v", r.failedUntil.Sub(now).Round(time.Second))
+		}
+		parts = append(parts, fmt.Sprintf("%s %s (%d dials, %d failures)", r.addr, state, r.dials, r.failures))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (p *RelayPool) reportLoop() {
+	for {
+		time.Sleep(p.opts.ReportInterval)
+		fmt.Printf("relays of %s: %s\n", p.name, p.summary())
+	}
+}
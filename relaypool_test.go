@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var errRelay = errors.New("connection refused")
+
+func relayPool(t *testing.T, rotate string, blacklist time.Duration) *RelayPool {
+	p, err := NewRelayPool("test", []string{"10.0.0.1:443", "10.0.0.2:443", "10.0.0.3:443"}, RelayOptions{
+		Rotate:    rotate,
+		Blacklist: blacklist,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func picks(p *RelayPool, n int) []string {
+	addrs := make([]string, n)
+	for i := range addrs {
+		addrs[i] = p.Pick()
+	}
+	return addrs
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRelayPoolOptions(t *testing.T) {
+	for _, tt := range []struct {
+		addrs  []string
+		rotate string
+	}{
+		{[]string{"10.0.0.1:443"}, "sometimes"},
+		{nil, RotateOnFailure},
+		{[]string{"10.0.0.1"}, RotateOnFailure},
+	} {
+		if _, err := NewRelayPool("test", tt.addrs, RelayOptions{Rotate: tt.rotate}); err == nil {
+			t.Fatalf("%v rotating per %q was accepted", tt.addrs, tt.rotate)
+		}
+	}
+}
+
+func TestRelayPoolRotation(t *testing.T) {
+	p := relayPool(t, RotatePerConnection, time.Minute)
+	if got := picks(p, 4); !equal(got, []string{"10.0.0.1:443", "10.0.0.2:443", "10.0.0.3:443", "10.0.0.1:443"}) {
+		t.Fatalf("rotating per connection picked %v", got)
+	}
+	p.Report("10.0.0.2:443", errRelay)
+	if got := picks(p, 3); !equal(got, []string{"10.0.0.3:443", "10.0.0.1:443", "10.0.0.3:443"}) {
+		t.Fatalf("rotating around a blacklisted relay picked %v", got)
+	}
+
+	// the relay is kept until it fails
+	p = relayPool(t, RotateOnFailure, time.Minute)
+	if got := picks(p, 2); !equal(got, []string{"10.0.0.1:443", "10.0.0.1:443"}) {
+		t.Fatalf("rotating on failure picked %v", got)
+	}
+	p.Report("10.0.0.1:443", errRelay)
+	if got := picks(p, 2); !equal(got, []string{"10.0.0.2:443", "10.0.0.2:443"}) {
+		t.Fatalf("rotating after a failure picked %v", got)
+	}
+}
+
+func TestRelayPoolBlacklist(t *testing.T) {
+	p := relayPool(t, RotateOnFailure, 100*time.Millisecond)
+	p.Report("10.0.0.1:443", errRelay)
+	p.Report("10.0.0.3:443", errRelay)
+	p.Report("10.0.0.2:443", errRelay)
+	// every relay is blacklisted, the one that leaves the blacklist first is tried
+	if got := p.Pick(); got != "10.0.0.1:443" {
+		t.Fatalf("picked %s instead of the relay blacklisted first", got)
+	}
+
+	// a relay that succeeds leaves the blacklist right away
+	p.Report("10.0.0.3:443", nil)
+	if got := p.Pick(); got != "10.0.0.3:443" {
+		t.Fatalf("picked %s instead of the relay that is reachable again", got)
+	}
+
+	// the blacklist expires
+	p.Report("10.0.0.3:443", errRelay)
+	time.Sleep(150 * time.Millisecond)
+	if got := p.Pick(); got != "10.0.0.3:443" {
+		t.Fatalf("picked %s once the blacklist has expired", got)
+	}
+}
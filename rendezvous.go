@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoPartner     = errors.New("the other path of the connection never arrived")
+	ErrPartnerClosed = errors.New("the other path of the connection is closed")
+)
+
+// Rendezvous pairs the upload and download paths of split connections by
+// their id. the first path to arrive dials the destination, and the paths
+// share the connection once all of them have arrived. a direction may be
+// striped over several paths
+type Rendezvous struct {
+	// timeout is how long a path waits for the other one
+	timeout time.Duration
+	// rules decides which destinations may be dialed
+	rules *DestRules
+
+	mutex   sync.Mutex
+	pending map[string]*splitConn
+}
+
+func NewRendezvous(timeout time.Duration, rules *DestRules) *Rendezvous {
+	return &Rendezvous{
+		timeout: timeout,
+		rules:   rules,
+		pending: make(map[string]*splitConn),
+	}
+}
+
+// splitConn is a destination connection shared by the paths of a split connection
+type splitConn struct {
+	id    string
+	dest  string
+	rules *DestRules
+	net   NetworkType
+
+	// dialed is closed once the destination has been dialed, destConn and
+	// dialErr are set then
+	dialed   chan struct{}
+	destConn net.Conn
+	dialErr  error
+	// paired is closed once every path has arrived
+	paired chan struct{}
+	// closed is closed once the connection is torn down, closeErr tells why
+	closed   chan struct{}
+	closeErr error
+
+	// the fields below are guarded by the mutex of the rendezvous
+	// paths holds the tunnels of the paths that have arrived, stripes the
+	// number of paths of each direction. neither changes once paired
+	paths   map[pathKey]net.Conn
+	stripes map[PathType]int
+	timer   *time.Timer
+	done    bool
+}
+
+type pathKey struct {
+	pType  PathType
+	stripe int
+}
+
+// join adds the path of q to its connection, it's created if it's the first
+// path. the caller must leave once it's done with the connection, and close
+// conn itself
+func (rv *Rendezvous) join(q *PathReq, conn net.Conn) (*splitConn, error) {
+	rv.mutex.Lock()
+	defer rv.mutex.Unlock()
+
+	sc, found := rv.pending[q.Id]
+	if !found {
+		sc = &splitConn{
+			id:      q.Id,
+			dest:    q.Dest,
+			rules:   rv.rules,
+			net:     q.Net,
+			dialed:  make(chan struct{}),
+			paired:  make(chan struct{}),
+			closed:  make(chan struct{}),
+			paths:   make(map[pathKey]net.Conn),
+			stripes: make(map[PathType]int),
+		}
+		sc.timer = time.AfterFunc(rv.timeout, func() { rv.expire(sc) })
+		rv.pending[q.Id] = sc
+		go sc.dial()
+	} else if sc.dest != q.Dest || sc.net != q.Net {
+		return nil, &HandshakeError{StatusBadRequest, HandshakeVersion,
+			fmt.Sprintf("split connection %s: paths disagree on the destination", q.Id)}
+	}
+	if n, found := sc.stripes[q.PType]; found && n != q.Stripes {
+		return nil, &HandshakeError{StatusBadRequest, HandshakeVersion,
+			fmt.Sprintf("split connection %s: paths disagree on the stripes", q.Id)}
+	}
+	key := pathKey{q.PType, q.Stripe}
+	if _, dup := sc.paths[key]; dup {
+		return nil, &HandshakeError{StatusBadRequest, HandshakeVersion,
+			fmt.Sprintf("split connection %s: path type %d stripe %d arrived twice", q.Id, q.PType, q.Stripe)}
+	}
+
+	sc.stripes[q.PType] = q.Stripes
+	sc.paths[key] = conn
+	if sc.complete() {
+		// every path is here, nothing has to find the connection anymore
+		sc.timer.Stop()
+		delete(rv.pending, sc.id)
+		close(sc.paired)
+	}
+	return sc, nil
+}
+
+// leave tears the connection down, the other path ends along with it if the
+// connection has been established. otherwise it's left to reply on its own
+func (rv *Rendezvous) leave(sc *splitConn) {
+	rv.mutex.Lock()
+	defer rv.mutex.Unlock()
+	if sc.done {
+		return
+	}
+	rv.shutdown(sc, ErrPartnerClosed)
+	if sc.complete() && sc.established() {
+		for _, conn := range sc.paths {
+			conn.Close()
+		}
+	}
+}
+
+// expire tears the connection down if its paths haven't paired in time
+func (rv *Rendezvous) expire(sc *splitConn) {
+	rv.mutex.Lock()
+	defer rv.mutex.Unlock()
+	if sc.complete() {
+		return
+	}
+	rv.shutdown(sc, ErrNoPartner)
+}
+
+// shutdown closes the destination, the mutex must be held. a connection that
+// hasn't paired is forgotten, so that paths arriving later start a new one
+func (rv *Rendezvous) shutdown(sc *splitConn, err error) {
+	if sc.done {
+		return
+	}
+	if rv.pending[sc.id] == sc {
+		delete(rv.pending, sc.id)
+	}
+	sc.timer.Stop()
+	sc.done = true
+	sc.closeErr = err
+	close(sc.closed)
+	go func() {
+		<-sc.dialed
+		if sc.destConn != nil {
+			sc.destConn.Close()
+			fmt.Println("connection to", sc.dest, "closed !")
+		}
+	}()
+}
+
+func (sc *splitConn) dial() {
+	defer close(sc.dialed)
+	fmt.Println("connecting to", sc.dest, "...")
+	netType := "tcp"
+	if sc.net == UDP {
+		netType = "udp"
+	}
+	sc.destConn, sc.dialErr = sc.rules.Dial(netType, sc.dest)
+	if sc.dialErr != nil {
+		fmt.Println("unable to connect to " + sc.dest + " " + sc.dialErr.Error())
+	}
+}
+
+// complete reports whether every path of both directions has arrived, the
+// mutex of the rendezvous must be held
+func (sc *splitConn) complete() bool {
+	up, hasUp := sc.stripes[Upload]
+	down, hasDown := sc.stripes[Download]
+	return hasUp && hasDown && len(sc.paths) == up+down
+}
+
+// conns returns the tunnels of a direction ordered by stripe, it's only
+// meant to be called once the paths have paired
+func (sc *splitConn) conns(pType PathType) []net.Conn {
+	conns := make([]net.Conn, sc.stripes[pType])
+	for i := range conns {
+		conns[i] = sc.paths[pathKey{pType, i}]
+	}
+	return conns
+}
+
+// established reports whether the destination has been dialed successfully
+func (sc *splitConn) established() bool {
+	select {
+	case <-sc.dialed:
+		return sc.dialErr == nil
+	default:
+		return false
+	}
+}
+
+// wait blocks until the destination has been dialed and every path has
+// arrived, a failed dial is reported right away
+func (sc *splitConn) wait() error {
+	<-sc.dialed
+	if sc.dialErr != nil {
+		return sc.dialErr
+	}
+	select {
+	case <-sc.paired:
+		// the other path may have left before this one arrived
+		select {
+		case <-sc.closed:
+			return sc.closeErr
+		default:
+			return nil
+		}
+	case <-sc.closed:
+		return sc.closeErr
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// destination returns the address of a listener that accepts and holds
+// connections until the end of the test
+func destination(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func splitReq(id, dest string, pType PathType, stripe, stripes int) *PathReq {
+	return &PathReq{Id: id, Dest: dest, Net: TCP, PType: pType, Stripe: stripe, Stripes: stripes}
+}
+
+// waitErr waits for the paths of sc to pair
+func waitErr(t *testing.T, sc *splitConn) error {
+	result := make(chan error, 1)
+	go func() { result <- sc.wait() }()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("the paths didn't pair in time")
+		return nil
+	}
+}
+
+func TestRendezvousPair(t *testing.T) {
+	rv := NewRendezvous(5*time.Second, nil)
+	dest := destination(t)
+	up0, _ := net.Pipe()
+	up1, _ := net.Pipe()
+	down, _ := net.Pipe()
+
+	sc, err := rv.join(splitReq("a", dest, Upload, 0, 2), up0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rv.join(splitReq("a", dest, Download, 0, 1), down); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sc.paired:
+		t.Fatal("the connection paired before its second upload stripe")
+	default:
+	}
+	if _, err := rv.join(splitReq("a", dest, Upload, 1, 2), up1); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitErr(t, sc); err != nil {
+		t.Fatal(err)
+	}
+	if conns := sc.conns(Upload); conns[0] != up0 || conns[1] != up1 {
+		t.Fatal("the upload stripes are out of order")
+	}
+
+	// a path that leaves ends the others along with it
+	rv.leave(sc)
+	if _, err := down.Write([]byte("x")); err == nil {
+		t.Fatal("the download path is still open")
+	}
+}
+
+func TestRendezvousMismatch(t *testing.T) {
+	rv := NewRendezvous(5*time.Second, nil)
+	dest := destination(t)
+	conn, _ := net.Pipe()
+	if _, err := rv.join(splitReq("a", dest, Upload, 0, 2), conn); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, q := range []*PathReq{
+		// the same path twice
+		splitReq("a", dest, Upload, 0, 2),
+		// another destination
+		splitReq("a", "127.0.0.1:1", Download, 0, 1),
+		// another number of stripes
+		splitReq("a", dest, Upload, 1, 3),
+	} {
+		var herr *HandshakeError
+		if _, err := rv.join(q, conn); !errors.As(err, &herr) || herr.Status != StatusBadRequest {
+			t.Fatalf("%+v: got %v instead of a bad request", q, err)
+		}
+	}
+}
+
+func TestRendezvousTimeout(t *testing.T) {
+	rv := NewRendezvous(100*time.Millisecond, nil)
+	dest := destination(t)
+	up, _ := net.Pipe()
+	sc, err := rv.join(splitReq("a", dest, Upload, 0, 1), up)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := waitErr(t, sc); err != ErrNoPartner {
+		t.Fatalf("got %v instead of ErrNoPartner", err)
+	}
+
+	// a partner arriving after the expiry starts a connection of its own,
+	// which expires as well
+	down, _ := net.Pipe()
+	late, err := rv.join(splitReq("a", dest, Download, 0, 1), down)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if late == sc {
+		t.Fatal("the late path joined the expired connection")
+	}
+	if err := waitErr(t, late); err != ErrNoPartner {
+		t.Fatalf("got %v instead of ErrNoPartner", err)
+	}
+}
+
+func TestRendezvousDialFailure(t *testing.T) {
+	rules, _ := NewDestRules([]string{"127.0.0.0/8"})
+	rv := NewRendezvous(5*time.Second, rules)
+	up, _ := net.Pipe()
+	sc, err := rv.join(splitReq("a", destination(t), Upload, 0, 1), up)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the failure is reported without waiting for the other path
+	if err := waitErr(t, sc); !errors.Is(err, ErrRuleBlocked) {
+		t.Fatalf("got %v instead of ErrRuleBlocked", err)
+	}
+	rv.leave(sc)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxRetryBackoff caps the wait between two attempts
+const maxRetryBackoff = 5 * time.Second
+
+// attemptTimeout bounds the handshake of a single attempt, the reply waits
+// for the server to dial the destination
+const attemptTimeout = HandshakeTimeout + DialTimeout
+
+// minIPDialTimeout is the least time an address of a host gets to answer
+const minIPDialTimeout = 2 * time.Second
+
+// RetryOptions controls how often a tunnel is tried before the socks client
+// gets a failure
+type RetryOptions struct {
+	// Retries is the number of attempts after the first one
+	Retries int
+	// Backoff is the wait before the first retry, it doubles with every retry
+	Backoff time.Duration
+	// Deadline bounds the time of all attempts together, 0 disables it
+	Deadline time.Duration
+}
+
+// backoff returns the wait before retry n, counted from 0. the jitter keeps
+// the retries of connections that failed together from arriving together
+func (o RetryOptions) backoff(n int) time.Duration {
+	d := o.Backoff
+	for i := 0; i < n && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+	if d > maxRetryBackoff {
+		d = maxRetryBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// isRetryable reports whether another attempt could succeed, the server's
+// answers about the destination are final. a split connection whose paths
+// didn't pair is retried as a whole
+func isRetryable(err error) bool {
+	var hsErr *HandshakeError
+	if errors.As(err, &hsErr) {
+		return hsErr.Status == StatusServerFailure || hsErr.Status == StatusNoPartner
+	}
+	return true
+}
+
+// preferredIPs remembers the address of a host that answered last, so that
+// dials start with it and move on to the others when it fails
+var preferredIPs = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// dialHost connects to one of the addresses of host, starting with the one
+// that worked last time
+func dialHost(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	ips, err := dnsResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	preferredIPs.Lock()
+	preferred := preferredIPs.m[host]
+	preferredIPs.Unlock()
+	for i, ip := range ips {
+		if ip.String() == preferred {
+			ips[0], ips[i] = ips[i], ips[0]
+			break
+		}
+	}
+
+	// an address that doesn't answer mustn't use up the time of the others
+	timeout := DialTimeout / time.Duration(len(ips))
+	if timeout < minIPDialTimeout {
+		timeout = minIPDialTimeout
+	}
+	for _, ip := range ips {
+		ipCtx, cancel := context.WithTimeout(ctx, timeout)
+		var conn net.Conn
+		conn, err = dialer.DialContext(ipCtx, network, net.JoinHostPort(ip.String(), port))
+		cancel()
+		if err == nil {
+			preferredIPs.Lock()
+			preferredIPs.m[host] = ip.String()
+			preferredIPs.Unlock()
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
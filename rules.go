@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// ErrRuleBlocked is returned when a destination is denied by the server's rules
+var ErrRuleBlocked = errors.New("destination blocked by rules")
+
+// DestRules denies destinations the server refuses to connect to. a rule is
+// an IP, a CIDR or a domain, which covers its subdomains too. IP rules are
+// checked against the address actually connected to, so they also catch
+// domains that resolve into a denied range
+type DestRules struct {
+	nets    []*net.IPNet
+	domains []string
+}
+
+// NewDestRules parses the rules, it returns nil when there are none
+func NewDestRules(rules []string) (*DestRules, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	r := &DestRules{}
+	for _, rule := range rules {
+		rule = strings.TrimSpace(rule)
+		switch {
+		case strings.Contains(rule, "/"):
+			_, ipNet, err := net.ParseCIDR(rule)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rule %q, %v", rule, err)
+			}
+			r.nets = append(r.nets, ipNet)
+		case net.ParseIP(rule) != nil:
+			ip := net.ParseIP(rule)
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			r.nets = append(r.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		case rule != "" && !strings.ContainsAny(rule, ":*"):
+			r.domains = append(r.domains, strings.ToLower(strings.Trim(rule, ".")))
+		default:
+			return nil, fmt.Errorf("invalid rule %q, it should be an ip, a cidr or a domain", rule)
+		}
+	}
+	return r, nil
+}
+
+// blockedHost reports whether host is a denied domain or IP
+func (r *DestRules) blockedHost(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return r.blockedIP(ip)
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, d := range r.domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *DestRules) blockedIP(ip net.IP) bool {
+	for _, n := range r.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Dial connects to the destination of a tunnel unless the rules deny it, a
+// nil DestRules allows everything
+func (r *DestRules) Dial(network, addr string) (net.Conn, error) {
+	if r == nil {
+		return net.DialTimeout(network, addr, DialTimeout)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if r.blockedHost(host) {
+		return nil, ErrRuleBlocked
+	}
+	dialer := &net.Dialer{
+		Timeout: DialTimeout,
+		// every address a domain resolves to is checked before it's connected to
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip != nil && r.blockedIP(ip) {
+				return ErrRuleBlocked
+			}
+			return nil
+		},
+	}
+	return dialer.Dial(network, addr)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"egg/socks5/statute"
+)
+
+func TestDestRules(t *testing.T) {
+	rules, err := NewDestRules([]string{"10.0.0.0/8", "192.168.1.1", "::1", "Example.com."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host    string
+		blocked bool
+	}{
+		{"10.1.2.3", true},
+		{"11.1.2.3", false},
+		{"192.168.1.1", true},
+		{"192.168.1.2", false},
+		{"::1", true},
+		{"example.com", true},
+		{"www.EXAMPLE.com", true},
+		{"example.com.", true},
+		{"notexample.com", false},
+		{"example.org", false},
+	}
+	for _, tt := range tests {
+		if blocked := rules.blockedHost(tt.host); blocked != tt.blocked {
+			t.Fatalf("%s: blocked is %v", tt.host, blocked)
+		}
+	}
+
+	for _, rule := range []string{"10.0.0.0/33", "*.example.com", "example.com:80", ""} {
+		if _, err := NewDestRules([]string{rule}); err == nil {
+			t.Fatalf("rule %q was accepted", rule)
+		}
+	}
+}
+
+func TestDestRulesDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	var allowAll *DestRules
+	conn, err := allowAll.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	rules, err := NewDestRules([]string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a domain is checked by the addresses it resolves to
+	for _, host := range []string{"127.0.0.1", "localhost"} {
+		_, err := rules.Dial("tcp", net.JoinHostPort(host, port))
+		if !errors.Is(err, ErrRuleBlocked) {
+			t.Fatalf("%s: got %v instead of ErrRuleBlocked", host, err)
+		}
+		if status := dialStatus(err); status != StatusRuleBlocked {
+			t.Fatalf("%s: got status %d", host, status)
+		}
+	}
+	if socksReply(StatusRuleBlocked) != statute.RepRuleFailure {
+		t.Fatal("a blocked destination isn't reported as a rule failure")
+	}
+}
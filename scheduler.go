@@ -4,7 +4,7 @@ import (
 	"fmt"
 )
 
-func Scheduler(fifo *FIFO, cp *ConnectionPool, endpoint string, relayEnabled bool) {
+func Scheduler(fifo *FIFO, cp *ConnectionPool, c *Client) {
 	for {
 		fmt.Println("waiting for new element in queue")
 		r, err := fifo.DequeueOrWaitForNextElement()
@@ -16,10 +16,13 @@ func Scheduler(fifo *FIFO, cp *ConnectionPool, endpoint string, relayEnabled boo
 		if !found {
 			panic("the connection with following connection id missing: " + req.Id)
 		}
-		if relayEnabled {
-			go relayClient(req, &socksReq, endpoint)
+		// the request has been handed over, nothing looks it up anymore
+		cp.RmConnection(req.Id)
+		u := c.balancer.Pick()
+		if u.split {
+			go c.relayClient(u, req, &socksReq)
 		} else {
-			go wsClient(req, &socksReq, endpoint, TwoWay)
+			go c.wsClient(u, req, newPathSession(&socksReq), TwoWay)
 		}
 	}
 }
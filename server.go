@@ -1,97 +1,247 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
+	"crypto/tls"
+	"egg/aead"
+	"egg/h2conn"
+	"egg/mux"
+	"egg/stripe"
 	"egg/wsconnadapter"
-	"encoding/binary"
-	"encoding/gob"
+	"errors"
 	"fmt"
 	"github.com/gorilla/websocket"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"io"
 	"net"
 	"net/http"
+	"path"
 	"strings"
+	"time"
 )
 
-type Server struct {
-	cp *ConnectionPool
+// ServerConfig holds the settings of a server instance
+type ServerConfig struct {
+	// Secret is the pre-shared key clients must authenticate with, empty accepts unauthenticated tunnels
+	Secret string
+	// RequireEncryption rejects tunnels without the inner encryption layer
+	RequireEncryption bool
+	// Path is the tunnel path prefix, every path below it is a tunnel path too
+	Path string
+	// PathToken is a secret segment appended to Path
+	PathToken string
+	Decoy     DecoyOptions
+	// PairTimeout is how long a path of a split connection waits for the other one
+	PairTimeout time.Duration
+	// Fallback handles requests to the tunnel path that aren't valid or
+	// authenticated upgrades, see newFallbackHandler
+	Fallback string
+	// Deny lists the destinations tunnels may not connect to, see DestRules
+	Deny []string
 }
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+type Server struct {
+	cfg ServerConfig
+	cp  *ConnectionPool
+	// rendezvous pairs the paths of split connections
+	rendezvous *Rendezvous
+	// rules denies destinations, it's nil when everything is allowed
+	rules *DestRules
+	// auth is nil when the server accepts unauthenticated tunnels
+	auth *PSKAuth
+	// decoy answers every request that isn't a tunnel
+	decoy http.Handler
+	// fallback answers requests to the tunnel path that can't be upgraded
+	fallback http.Handler
+	upgrader websocket.Upgrader
 }
 
-func (sf *Server) get(w http.ResponseWriter, r *http.Request) {
-	fmt.Printf("new get request")
-	_, err := io.WriteString(w, "This is my website!\n")
-	if err != nil {
+// tunnel serves the tunnel path, tunnels are either websocket upgrades,
+// HTTP/2 streams or polling sessions
+func (sf *Server) tunnel(w http.ResponseWriter, r *http.Request, handle TunnelHandler) {
+	pollReq, isPoll := parsePollRequest(r, sf.tunnelPath())
+	isH2 := !isPoll && r.ProtoMajor == 2 && r.Method == http.MethodPost
+	if !isPoll && !isH2 && !websocket.IsWebSocketUpgrade(r) {
+		sf.fallback.ServeHTTP(w, r)
 		return
 	}
-}
-func (sf *Server) ws(w http.ResponseWriter, r *http.Request) {
-	wsConn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
-		fmt.Printf("HTTP SERVER, WS Connection Upgrade: %v", err.Error())
-		return
+	if sf.auth != nil {
+		token, err := r.Cookie(upgradeCookie)
+		if err == nil {
+			err = sf.auth.verifyUpgradeToken(token.Value)
+		}
+		if err != nil {
+			fmt.Printf("unauthenticated upgrade from %s: %v\n", r.RemoteAddr, err)
+			sf.fallback.ServeHTTP(w, r)
+			return
+		}
 	}
-	conn := wsconnadapter.New(wsConn)
 
-	size := make([]byte, 2)
-	conn.Read(size)
-
-	fmt.Println(size)
+	if isPoll {
+		sf.servePoll(w, r, pollReq, handle)
+		return
+	}
 
-	data := make([]byte, binary.BigEndian.Uint16(size))
-	conn.Read(data)
+	var conn net.Conn
+	if isH2 {
+		// the response headers go out right away, the client waits for them
+		w.WriteHeader(http.StatusOK)
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		conn = h2conn.Server(w, r)
+	} else {
+		// invalid upgrades are handed to the fallback by the upgrader
+		wsConn, err := sf.upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			fmt.Printf("failed upgrade from %s: %v\n", r.RemoteAddr, err)
+			return
+		}
+		conn = wsconnadapter.New(wsConn)
+	}
+	// the handler must not return before the tunnel is closed, HTTP/2 streams end with it
+	handle(conn)
+}
 
-	var reqAck bytes.Buffer
-	reqAck.Write(data)
-	dec := gob.NewDecoder(&reqAck) // Will read from network.
-	var q PathReq
-	err = dec.Decode(&q)
+// handleTunnel serves a tunnel stream of any transport
+func (sf *Server) handleTunnel(conn net.Conn) {
+	conn, err := sf.decrypt(conn)
 	if err != nil {
+		fmt.Println("rejected tunnel:", err)
 		return
 	}
+	sf.serve(conn)
+}
 
-	fmt.Println("connecting to", q.Dest, "...")
-	defer fmt.Println("connection to", q.Dest, "closed !")
+// decrypt detects tunnels that start with an encryption preface and wraps them
+// with the inner encryption layer. the key exchange must complete within
+// HandshakeTimeout like the handshake that follows it
+func (sf *Server) decrypt(conn net.Conn) (net.Conn, error) {
+	_ = conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	br := bufio.NewReader(conn)
+	magic, err := br.Peek(2)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
 
-	var destConn net.Conn
+	conn = &bufferedConn{conn, br}
+	if !aead.IsPreface(magic) {
+		if sf.cfg.RequireEncryption {
+			conn.Close()
+			return nil, errors.New("tunnel is not encrypted")
+		}
+		_ = conn.SetDeadline(time.Time{})
+		return conn, nil
+	}
+
+	var psk []byte
+	if sf.auth != nil {
+		psk = sf.auth.key
+	}
+	encConn, err := aead.Server(conn, psk)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return encConn, nil
+}
 
-	destConn, found := sf.cp.GetSrvConnection(q.Id)
+// bufferedConn is a net.Conn whose reads go through a bufio.Reader
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
 
-	if !found {
-		// connect to remote server
-		netType := "tcp"
-		if q.Net == UDP {
-			netType = "udp"
-		}
+func (bc *bufferedConn) Read(b []byte) (int, error) {
+	return bc.r.Read(b)
+}
 
-		destConn, err = net.Dial(netType, q.Dest)
+// serve handles a single tunnel, conn is either a websocket or a stream of a multiplexed tunnel
+func (sf *Server) serve(conn net.Conn) {
+	// a client that doesn't complete its handshake in time is dropped
+	timeout := HandshakeTimeout
+	var q *PathReq
+	var err error
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+		q, err = readPathReq(conn, sf.auth)
 		if err != nil {
-			fmt.Println("unable to connect to" + q.Dest + " " + err.Error())
+			var hsErr *HandshakeError
+			if errors.As(err, &hsErr) {
+				_ = writeHandshakeReply(conn, hsErr.Status)
+			}
+			fmt.Println("rejected tunnel:", err)
+			conn.Close()
+			return
+		}
+		if q.PType != Ping {
+			break
+		}
+		if err := writeHandshakeReply(conn, StatusOK); err != nil {
+			conn.Close()
 			return
 		}
+		// the tunnel idles in the client's pool until it's used or pinged again
+		timeout = TunnelIdleTimeout
+	}
+	_ = conn.SetReadDeadline(time.Time{})
 
-		if q.PType != TwoWay {
-			sf.cp.NewSrvConnection(q.Id, destConn)
+	if q.PType == Multiplex {
+		if _, isStream := conn.(*mux.Stream); isStream {
+			// nested multiplexing is not allowed
+			_ = writeHandshakeReply(conn, StatusBadRequest)
+			conn.Close()
+			return
+		}
+		if err := writeHandshakeReply(conn, StatusOK); err != nil {
+			conn.Close()
+			return
 		}
+		sf.serveMux(conn)
+		return
+	}
+
+	if q.PType != TwoWay {
+		sf.serveSplit(conn, q)
+		return
+	}
+
+	fmt.Println("connecting to", q.Dest, "...")
+	defer fmt.Println("connection to", q.Dest, "closed !")
+
+	// connect to remote server
+	netType := "tcp"
+	if q.Net == UDP {
+		netType = "udp"
+	}
+
+	destConn, err := sf.rules.Dial(netType, q.Dest)
+	if err != nil {
+		fmt.Println("unable to connect to" + q.Dest + " " + err.Error())
+		_ = writeHandshakeReply(conn, dialStatus(err))
+		conn.Close()
+		return
+	}
+
+	if err := writeHandshakeReply(conn, StatusOK); err != nil {
+		destConn.Close()
+		conn.Close()
+		return
+	}
+	if q.Net == UDP {
+		enableDatagrams(conn)
 	}
 
 	errCh := make(chan error, 2)
 
 	// upload path
-	if q.PType == Upload || q.PType == TwoWay {
-		go func() { errCh <- Copy(conn, destConn) }()
-	}
+	go func() { errCh <- Copy(conn, destConn) }()
 
 	// download path
-	if q.PType == Download || q.PType == TwoWay {
-		go func() { errCh <- Copy(destConn, conn) }()
-	}
+	go func() { errCh <- Copy(destConn, conn) }()
 
 	// Wait
 	err = <-errCh
@@ -103,17 +253,184 @@ func (sf *Server) ws(w http.ResponseWriter, r *http.Request) {
 	conn.Close()
 }
 
-func (sf *Server) ListenAndServe(addr string) error {
+// serveSplit serves a path of a split connection, it shares the destination
+// with the other paths of the connection
+func (sf *Server) serveSplit(conn net.Conn, q *PathReq) {
+	defer conn.Close()
+	sc, err := sf.rendezvous.join(q, conn)
+	if err != nil {
+		fmt.Println("rejected tunnel:", err)
+		var hsErr *HandshakeError
+		if errors.As(err, &hsErr) {
+			_ = writeHandshakeReply(conn, hsErr.Status)
+		}
+		return
+	}
+	defer sf.rendezvous.leave(sc)
+
+	if err := sc.wait(); err != nil {
+		status := StatusServerFailure
+		switch {
+		case err == sc.dialErr:
+			status = dialStatus(err)
+		case errors.Is(err, ErrNoPartner):
+			fmt.Printf("split connection %s: %v\n", q.Id, err)
+			status = StatusNoPartner
+		}
+		_ = writeHandshakeReply(conn, status)
+		return
+	}
+
+	if err := writeHandshakeReply(conn, StatusOK); err != nil {
+		return
+	}
+	if q.Net == UDP && q.Stripes <= 1 {
+		enableDatagrams(conn)
+	}
+
+	if q.Stripe != 0 {
+		// the first stripe moves the data of the whole direction, the
+		// others stay until the connection is torn down
+		<-sc.closed
+		return
+	}
+	conns := sc.conns(q.PType)
+	if q.PType == Upload {
+		readers := make([]io.Reader, len(conns))
+		for i, c := range conns {
+			readers[i] = c
+		}
+		err = stripe.Receive(sc.destConn, readers)
+	} else {
+		writers := make([]io.Writer, len(conns))
+		for i, c := range conns {
+			writers[i] = c
+		}
+		err = stripe.Send(writers, sc.destConn)
+	}
+	if err != nil && !strings.Contains(err.Error(), "websocket: close 1006") {
+		fmt.Println("transport error:", err)
+	}
+}
+
+// serveMux accepts the streams of a multiplexed tunnel and serves each of them as a separate tunnel
+func (sf *Server) serveMux(conn net.Conn) {
+	sess := mux.Server(conn)
+	defer sess.Close()
+	for {
+		stream, err := sess.AcceptStream()
+		if err != nil {
+			return
+		}
+		go sf.serve(stream)
+	}
+}
+
+// Serve accepts the tunnels of a transport until it fails
+func (sf *Server) Serve(t ServerTransport) error {
+	return t.Serve(sf.handleTunnel)
+}
+
+// ListenAndServe serves plain HTTP, or HTTPS when tlsConfig isn't nil
+func (sf *Server) ListenAndServe(addr string, tlsConfig *tls.Config) error {
+	return sf.Serve(sf.NewHTTPTransport(addr, tlsConfig))
+}
+
+// HTTPTransport serves websocket, HTTP/2 and polling tunnels on the tunnel
+// path of an HTTP(S) server, everything else goes to the decoy
+type HTTPTransport struct {
+	sf  *Server
+	srv *http.Server
+}
+
+// NewHTTPTransport returns a transport serving plain HTTP, or HTTPS when tlsConfig isn't nil
+func (sf *Server) NewHTTPTransport(addr string, tlsConfig *tls.Config) *HTTPTransport {
+	return &HTTPTransport{
+		sf: sf,
+		srv: &http.Server{
+			Addr:      addr,
+			TLSConfig: tlsConfig,
+		},
+	}
+}
+
+func (t *HTTPTransport) Serve(handle TunnelHandler) error {
+	t.srv.Handler = t.handler(handle)
+	if t.srv.TLSConfig != nil {
+		return t.srv.ListenAndServeTLS("", "")
+	}
+	return t.srv.ListenAndServe()
+}
+
+// handler routes the tunnel path to the tunnels and everything else to the decoy
+func (t *HTTPTransport) handler(handle TunnelHandler) http.Handler {
+	tunnel := func(w http.ResponseWriter, r *http.Request) {
+		t.sf.tunnel(w, r, handle)
+	}
+	tunnelPath := t.sf.tunnelPath()
 	mux := http.NewServeMux()
-	mux.HandleFunc("/ws", sf.ws)
-	mux.HandleFunc("/", sf.get)
+	if tunnelPath == "/" {
+		// every path is a tunnel path, whatever isn't a tunnel goes to the
+		// fallback, which is the decoy unless it's configured
+		mux.HandleFunc("/", tunnel)
+	} else {
+		mux.HandleFunc(tunnelPath, tunnel)
+		// clients may randomize the rest of the path
+		mux.HandleFunc(tunnelPath+"/", tunnel)
+		mux.Handle("/", t.sf.decoy)
+	}
+	// cleartext HTTP/2 is accepted alongside HTTP/1.1, TLS negotiates it with ALPN
+	return h2c.NewHandler(mux, &http2.Server{})
+}
 
-	return http.ListenAndServe(addr, mux)
+func (t *HTTPTransport) Close() error {
+	return t.srv.Close()
 }
 
-func NewServer() *Server {
+// tunnelPath returns the path prefix tunnels are accepted under
+func (sf *Server) tunnelPath() string {
+	p := "/" + strings.Trim(sf.cfg.Path, "/")
+	if sf.cfg.PathToken != "" {
+		p = path.Join(p, sf.cfg.PathToken)
+	}
+	return p
+}
+
+func NewServer(cfg ServerConfig) (*Server, error) {
+	if cfg.RequireEncryption && cfg.Secret == "" {
+		return nil, errors.New("encryption needs a pre-shared key")
+	}
+	decoy, err := newDecoyHandler(cfg.Decoy)
+	if err != nil {
+		return nil, err
+	}
+	fallback, err := newFallbackHandler(cfg.Fallback, decoy)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := NewDestRules(cfg.Deny)
+	if err != nil {
+		return nil, err
+	}
 	cp := NewConnectionPool()
-	return &Server{
-		cp,
+	var auth *PSKAuth
+	if cfg.Secret != "" {
+		auth = NewPSKAuth(cfg.Secret)
 	}
+	return &Server{
+		cfg:        cfg,
+		cp:         cp,
+		rendezvous: NewRendezvous(cfg.PairTimeout, rules),
+		rules:      rules,
+		auth:       auth,
+		decoy:      decoy,
+		fallback:   fallback,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			Error: func(w http.ResponseWriter, r *http.Request, _ int, _ error) {
+				fallback.ServeHTTP(w, r)
+			},
+		},
+	}, nil
 }
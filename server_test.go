@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// tunnelServer serves the HTTP transport of a server with cfg, the tunnels it
+// accepts are delivered on the channel
+func tunnelServer(t *testing.T, cfg ServerConfig) (*httptest.Server, <-chan net.Conn) {
+	sf, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnels := make(chan net.Conn, 1)
+	ts := httptest.NewServer(sf.NewHTTPTransport("", nil).handler(func(conn net.Conn) {
+		tunnels <- conn
+		// like the real handler, it returns once the tunnel is done
+		conn.Read(make([]byte, 1))
+	}))
+	t.Cleanup(ts.Close)
+	return ts, tunnels
+}
+
+func TestTunnelPaths(t *testing.T) {
+	tests := []struct {
+		path    string
+		tunnels []string
+		decoyed []string
+	}{
+		{"/ws", []string{"/ws", "/ws/random"}, []string{"/", "/other", "/wsx"}},
+		{"/", []string{"/", "/ws", "/random/path"}, nil},
+	}
+	for _, tt := range tests {
+		ts, tunnels := tunnelServer(t, ServerConfig{Path: tt.path})
+		wsURL := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+		for _, p := range tt.tunnels {
+			wsConn, _, err := websocket.DefaultDialer.Dial(wsURL+p, nil)
+			if err != nil {
+				t.Fatalf("path %s: upgrade at %s failed: %v", tt.path, p, err)
+			}
+			(<-tunnels).Close()
+			wsConn.Close()
+		}
+		for _, p := range tt.decoyed {
+			if _, _, err := websocket.DefaultDialer.Dial(wsURL+p, nil); err == nil {
+				t.Fatalf("path %s: upgrade at %s was accepted", tt.path, p)
+			}
+		}
+
+		// requests that aren't tunnels get the decoy's answer, even at the tunnel path
+		resp, err := http.Get(ts.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("path %s: a plain request got %d", tt.path, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package stripe
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// A stream striped over several tunnels is cut into frames, each of them is
+// sent over whichever tunnel is ready first:
+//
+// +-----+--------+----------+
+// | SEQ | LENGTH |  PAYLOAD |
+// +-----+--------+----------+
+// |  4  |   2    | Variable |
+// +-----+--------+----------+
+//
+// SEQ counts the frames of the stream from 0 and LENGTH is the size of the
+// payload, both are big endian. The receiver puts the frames back in order.
+// Once the stream has ended, every tunnel carries a last frame without
+// payload whose SEQ is the number of frames of the stream, a tunnel that
+// ends without it has failed.
+const (
+	headerSize = 6
+	// MaxFrameSize is the largest payload a single frame can carry
+	MaxFrameSize = 16 * 1024
+	// Window is how many frames the receiver buffers ahead of the next one it
+	// delivers, a tunnel that's further ahead waits for the others
+	Window = 64
+)
+
+var (
+	errInvalidFrame = errors.New("stripe: invalid frame")
+	errIncomplete   = errors.New("stripe: the stream ended with frames missing")
+)
+
+// Send reads r until it fails and stripes what it reads over conns. a single
+// conn carries the stream as is, without framing
+func Send(conns []io.Writer, r io.Reader) error {
+	if len(conns) == 1 {
+		_, err := io.Copy(conns[0], r)
+		return err
+	}
+
+	frames := make(chan []byte, len(conns))
+	// failed is closed once a tunnel fails, the frames it lost can't be replaced
+	failed := make(chan struct{})
+	var failOnce sync.Once
+	var writeErr error
+	fail := func(err error) {
+		failOnce.Do(func() {
+			writeErr = err
+			close(failed)
+		})
+	}
+	var seq uint32
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn io.Writer) {
+			defer wg.Done()
+			for f := range frames {
+				if _, err := conn.Write(f); err != nil {
+					fail(err)
+					return
+				}
+			}
+			// frames is closed once seq is final
+			fin := make([]byte, headerSize)
+			binary.BigEndian.PutUint32(fin, seq)
+			if _, err := conn.Write(fin); err != nil {
+				fail(err)
+			}
+		}(conn)
+	}
+
+	var err error
+	for err == nil {
+		f := make([]byte, headerSize+MaxFrameSize)
+		var n int
+		n, err = r.Read(f[headerSize:])
+		if n == 0 {
+			continue
+		}
+		binary.BigEndian.PutUint32(f, seq)
+		binary.BigEndian.PutUint16(f[4:], uint16(n))
+		select {
+		case frames <- f[:headerSize+n]:
+			seq++
+		case <-failed:
+			err = writeErr
+		}
+	}
+	close(frames)
+	wg.Wait()
+
+	if writeErr != nil {
+		return writeErr
+	}
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// Receive reads the frames of a stream striped over conns and writes them to
+// w in order, until the stream has ended, a conn fails or w fails. a single
+// conn carries the stream as is, without framing
+func Receive(w io.Writer, conns []io.Reader) error {
+	if len(conns) == 1 {
+		_, err := io.Copy(w, conns[0])
+		return err
+	}
+
+	var mutex sync.Mutex
+	cond := sync.NewCond(&mutex)
+	pending := make(map[uint32][]byte)
+	var next uint32
+	// alive is the number of conns that haven't ended yet
+	alive := len(conns)
+	// total is the number of frames of the stream, it's known once a conn
+	// has ended
+	var total uint32
+	ended := false
+	stopped := false
+	var readErr error
+	stop := func(err error) {
+		if !stopped {
+			stopped = true
+			readErr = err
+			cond.Broadcast()
+		}
+	}
+
+	for _, conn := range conns {
+		go func(conn io.Reader) {
+			header := make([]byte, headerSize)
+			for {
+				seq, data, err := readFrame(conn, header)
+				mutex.Lock()
+				switch {
+				case err == io.EOF:
+					// the tunnel ended without the last frame
+					stop(io.ErrUnexpectedEOF)
+				case err != nil:
+					stop(err)
+				case data == nil:
+					if ended && seq != total {
+						stop(errInvalidFrame)
+					}
+					ended, total = true, seq
+					alive--
+					cond.Broadcast()
+					mutex.Unlock()
+					return
+				case seq < next || pending[seq] != nil:
+					stop(errInvalidFrame)
+				}
+				for !stopped && seq-next >= Window {
+					cond.Wait()
+				}
+				if stopped {
+					mutex.Unlock()
+					return
+				}
+				pending[seq] = data
+				cond.Broadcast()
+				mutex.Unlock()
+			}
+		}(conn)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for {
+		data, ok := pending[next]
+		for !ok && !stopped && alive > 0 {
+			cond.Wait()
+			data, ok = pending[next]
+		}
+		if stopped {
+			return readErr
+		}
+		if !ok {
+			// every conn has ended, each of them after all of its frames
+			if next != total || len(pending) != 0 {
+				return errIncomplete
+			}
+			return nil
+		}
+		delete(pending, next)
+		next++
+		cond.Broadcast()
+
+		mutex.Unlock()
+		_, err := w.Write(data)
+		mutex.Lock()
+		if err != nil {
+			// readers blocked on the window give up, the others end once
+			// their tunnel is closed
+			stop(err)
+			return err
+		}
+	}
+}
+
+// readFrame reads a frame, the last frame of a tunnel is returned without data
+func readFrame(r io.Reader, header []byte) (uint32, []byte, error) {
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	seq := binary.BigEndian.Uint32(header)
+	length := int(binary.BigEndian.Uint16(header[4:]))
+	if length == 0 {
+		return seq, nil, nil
+	}
+	if length > MaxFrameSize {
+		return 0, nil, errInvalidFrame
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return seq, data, nil
+}
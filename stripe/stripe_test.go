@@ -0,0 +1,178 @@
+package stripe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// tunnels returns n pipes, the writers for Send and the readers for Receive
+func tunnels(n int) ([]*io.PipeReader, []*io.PipeWriter) {
+	readers := make([]*io.PipeReader, n)
+	writers := make([]*io.PipeWriter, n)
+	for i := range readers {
+		readers[i], writers[i] = io.Pipe()
+	}
+	return readers, writers
+}
+
+func randomData(t *testing.T, size int) []byte {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// smallReads makes Send cut the stream into many frames
+type smallReads struct {
+	r    io.Reader
+	size int
+}
+
+func (s *smallReads) Read(b []byte) (int, error) {
+	if len(b) > s.size {
+		b = b[:s.size]
+	}
+	return s.r.Read(b)
+}
+
+// slowReader delays every read of a tunnel
+type slowReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (s *slowReader) Read(b []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.r.Read(b)
+}
+
+// failingWriter fails a tunnel once limit bytes have been written to it
+type failingWriter struct {
+	w       *io.PipeWriter
+	limit   int
+	written int
+}
+
+var errBroken = errors.New("tunnel broken")
+
+func (f *failingWriter) Write(b []byte) (int, error) {
+	if f.written+len(b) > f.limit {
+		f.w.CloseWithError(errBroken)
+		return 0, errBroken
+	}
+	f.written += len(b)
+	return f.w.Write(b)
+}
+
+// transfer stripes data from Send to Receive, the tunnels are closed once Send
+// returns unless keepOpen is set. it fails the test if Receive doesn't return
+// in time
+func transfer(t *testing.T, data []byte, senders []io.Writer, receivers []io.Reader, writers []*io.PipeWriter, keepOpen bool) ([]byte, error) {
+	go func() {
+		err := Send(senders, &smallReads{bytes.NewReader(data), 1000})
+		if keepOpen {
+			return
+		}
+		if err != nil {
+			t.Errorf("Send: %v", err)
+		}
+		// like the paths of a connection, the tunnels are torn down right away
+		for _, w := range writers {
+			w.Close()
+		}
+	}()
+
+	var out bytes.Buffer
+	done := make(chan error, 1)
+	go func() { done <- Receive(&out, receivers) }()
+	select {
+	case err := <-done:
+		return out.Bytes(), err
+	case <-time.After(10 * time.Second):
+		t.Fatal("Receive didn't return")
+		return nil, nil
+	}
+}
+
+func TestInOrder(t *testing.T) {
+	for _, n := range []int{1, 2, 4, 8} {
+		readers, writers := tunnels(n)
+		senders := make([]io.Writer, n)
+		receivers := make([]io.Reader, n)
+		for i := range readers {
+			senders[i], receivers[i] = writers[i], readers[i]
+		}
+
+		data := randomData(t, 1<<20)
+		out, err := transfer(t, data, senders, receivers, writers, false)
+		if err != nil {
+			t.Fatalf("%d tunnels: %v", n, err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Fatalf("%d tunnels: received %d bytes that differ from the %d sent", n, len(out), len(data))
+		}
+	}
+}
+
+func TestSlowTunnel(t *testing.T) {
+	readers, writers := tunnels(4)
+	senders := make([]io.Writer, 4)
+	receivers := make([]io.Reader, 4)
+	for i := range readers {
+		senders[i], receivers[i] = writers[i], readers[i]
+	}
+	// the fast tunnels run into the window while the slow one lags behind
+	receivers[0] = &slowReader{readers[0], time.Millisecond}
+
+	data := randomData(t, 1<<20)
+	out, err := transfer(t, data, senders, receivers, writers, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatalf("received %d bytes that differ from the %d sent", len(out), len(data))
+	}
+}
+
+func TestTunnelFailure(t *testing.T) {
+	readers, writers := tunnels(4)
+	senders := make([]io.Writer, 4)
+	receivers := make([]io.Reader, 4)
+	for i := range readers {
+		senders[i], receivers[i] = writers[i], readers[i]
+	}
+	senders[1] = &failingWriter{w: writers[1], limit: 64 * 1024}
+
+	// the other tunnels stay open, Receive must notice the failure on its own
+	_, err := transfer(t, randomData(t, 4<<20), senders, receivers, writers, true)
+	if !errors.Is(err, errBroken) {
+		t.Fatalf("Receive returned %v instead of the tunnel's error", err)
+	}
+	for _, r := range readers {
+		r.Close()
+	}
+}
+
+func TestMissingLastFrame(t *testing.T) {
+	readers, writers := tunnels(2)
+	receivers := []io.Reader{readers[0], readers[1]}
+	done := make(chan error, 1)
+	go func() { done <- Receive(io.Discard, receivers) }()
+
+	// a tunnel that ends without its last frame has lost the ones after it
+	writers[0].Close()
+	select {
+	case err := <-done:
+		if err != io.ErrUnexpectedEOF {
+			t.Fatalf("Receive returned %v instead of io.ErrUnexpectedEOF", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Receive didn't return")
+	}
+	writers[1].Close()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+)
+
+// tcpALPN is what raw TLS tunnels advertise, so that they look like HTTPS connections
+var tcpALPN = []string{"http/1.1"}
+
+// TCPDialer opens every tunnel as a raw TCP connection that carries the
+// handshake right away, tcp:// endpoints select it and tcps:// endpoints add
+// TLS. a relay command can stand in front of the server, since there's
+// nothing to route by
+type TCPDialer struct {
+	*DialSettings
+}
+
+func NewTCPDialer(s *DialSettings) (*TCPDialer, error) {
+	u, err := url.Parse(s.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("%s endpoints need a port", u.Scheme)
+	}
+	return &TCPDialer{s}, nil
+}
+
+func (d *TCPDialer) Dial(pathType PathType) (net.Conn, error) {
+	u, err := url.Parse(d.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DialTimeout+HandshakeTimeout)
+	defer cancel()
+	if u.Scheme == "tcp" {
+		return d.dialTCP(ctx, "tcp", u.Host)
+	}
+	return d.dialTLS(ctx, "tcp", u.Host, tcpALPN)
+}
+
+// ListenAndServeTCP serves raw TCP tunnels, with TLS when tlsConfig isn't nil
+func (sf *Server) ListenAndServeTCP(addr string, tlsConfig *tls.Config) error {
+	return sf.Serve(NewTCPTransport(addr, tlsConfig))
+}
+
+// TCPTransport accepts raw TCP connections, every connection is a tunnel
+type TCPTransport struct {
+	addr   string
+	config *tls.Config
+
+	mutex sync.Mutex
+	ln    net.Listener
+}
+
+func NewTCPTransport(addr string, tlsConfig *tls.Config) *TCPTransport {
+	return &TCPTransport{
+		addr:   addr,
+		config: tlsConfig,
+	}
+}
+
+func (t *TCPTransport) Serve(handle TunnelHandler) error {
+	ln, err := net.Listen("tcp", t.addr)
+	if err != nil {
+		return err
+	}
+	if t.config != nil {
+		ln = tls.NewListener(ln, t.config)
+	}
+	t.mutex.Lock()
+	t.ln = ln
+	t.mutex.Unlock()
+
+	fmt.Printf("Serving raw TCP tunnels at %s ...\n", t.addr)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go handle(conn)
+	}
+}
+
+func (t *TCPTransport) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.ln == nil {
+		return nil
+	}
+	return t.ln.Close()
+}
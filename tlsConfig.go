@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	stdtls "crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	tls "github.com/refraction-networking/utls"
+	"os"
+	"strings"
+)
+
+// TLSOptions controls how the client verifies the certificate of the server
+type TLSOptions struct {
+	// Insecure skips certificate verification entirely
+	Insecure bool
+	// PinCert is the SHA-256 of the DER encoded certificate the server must present
+	PinCert string
+	// PinPubKey is the SHA-256 of the DER encoded public key the server must present
+	PinPubKey string
+	// CAFile is a PEM bundle of CAs to trust instead of the system roots
+	CAFile string
+}
+
+var ErrPinMismatch = errors.New("tls: server certificate doesn't match the pinned fingerprint")
+
+// newTLSConfig builds the uTLS config template of the client, ServerName is set per dial.
+// A pinned certificate or public key is trusted on its own, even if it's self-signed
+func newTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	config := &tls.Config{}
+
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read ca bundle: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.CAFile)
+		}
+	}
+
+	if opts.Insecure {
+		config.InsecureSkipVerify = true
+		return config, nil
+	}
+
+	if opts.PinCert == "" && opts.PinPubKey == "" {
+		return config, nil
+	}
+
+	var certPin, keyPin []byte
+	var err error
+	if opts.PinCert != "" {
+		if certPin, err = parseFingerprint(opts.PinCert); err != nil {
+			return nil, err
+		}
+	}
+	if opts.PinPubKey != "" {
+		if keyPin, err = parseFingerprint(opts.PinPubKey); err != nil {
+			return nil, err
+		}
+	}
+
+	// the chain isn't verified against any CA, the pin is verified instead.
+	// only the leaf counts, since its key is the one signing the handshake and
+	// anyone can append the real certificate to their own chain
+	config.InsecureSkipVerify = true
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("tls: server presented no certificate")
+		}
+		leaf := rawCerts[0]
+		if certPin != nil {
+			sum := sha256.Sum256(leaf)
+			if bytes.Equal(sum[:], certPin) {
+				return nil
+			}
+		}
+		if keyPin != nil {
+			cert, err := x509.ParseCertificate(leaf)
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			if bytes.Equal(sum[:], keyPin) {
+				return nil
+			}
+		}
+		return ErrPinMismatch
+	}
+	return config, nil
+}
+
+// parseFingerprint decodes a SHA-256 fingerprint given as hex (colons are
+// allowed) or base64, optionally prefixed with "sha256/" or "sha256//"
+func parseFingerprint(s string) ([]byte, error) {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "sha256/"), "/")
+	if b, err := hex.DecodeString(strings.ReplaceAll(s, ":", "")); err == nil && len(b) == sha256.Size {
+		return b, nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil && len(b) == sha256.Size {
+		return b, nil
+	}
+	return nil, fmt.Errorf("invalid sha256 fingerprint %q", s)
+}
+
+// verifyHostname makes config verify the server certificate against name
+// while the ClientHello carries no server name at all
+func verifyHostname(config *tls.Config, name string) {
+	config.ServerName = ""
+	if config.InsecureSkipVerify {
+		// either verification is disabled or a pin already verifies the certificate
+		return
+	}
+	roots := config.RootCAs
+	config.InsecureSkipVerify = true
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+		if len(certs) == 0 {
+			return errors.New("tls: server presented no certificate")
+		}
+		opts := x509.VerifyOptions{
+			Roots:         roots,
+			DNSName:       name,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(opts)
+		return err
+	}
+}
+
+// stdTLSConfig converts a client config for crypto/tls, which is what QUIC
+// needs since its handshake can't be shaped by uTLS
+func stdTLSConfig(config *tls.Config) *stdtls.Config {
+	return &stdtls.Config{
+		ServerName:            config.ServerName,
+		RootCAs:               config.RootCAs,
+		InsecureSkipVerify:    config.InsecureSkipVerify,
+		VerifyPeerCertificate: config.VerifyPeerCertificate,
+	}
+}
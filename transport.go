@@ -1,18 +1,22 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"egg/socks5"
 	"egg/socks5/statute"
+	"egg/stripe"
 	"egg/wsconnadapter"
-	"encoding/binary"
-	"encoding/gob"
+	"errors"
 	"fmt"
 	"github.com/gorilla/websocket"
 	tls "github.com/refraction-networking/utls"
+	"io"
+	mrand "math/rand"
 	"net"
+	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,98 +25,354 @@ var portMap = map[string]string{
 	"https": "443",
 }
 
-func plainTCPDial(ctx context.Context, network, addr string, pathType PathType) (net.Conn, error) {
+// dnsResolver resolves the addresses tunnels connect to
+var dnsResolver = func() *net.Resolver {
 	var (
 		dnsResolverIP        = "8.8.8.8:53" // Google DNS resolver.
 		dnsResolverProto     = "udp"        // Protocol to use for the DNS resolver
 		dnsResolverTimeoutMs = 5000         // Timeout (ms) for the DNS resolver (optional)
 	)
 
-	dialer := &net.Dialer{
-		Resolver: &net.Resolver{
-			PreferGo: true,
-			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-				d := net.Dialer{
-					Timeout: time.Duration(dnsResolverTimeoutMs) * time.Millisecond,
-				}
-				return d.DialContext(ctx, dnsResolverProto, dnsResolverIP)
-			},
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := net.Dialer{
+				Timeout: time.Duration(dnsResolverTimeoutMs) * time.Millisecond,
+			}
+			return d.DialContext(ctx, dnsResolverProto, dnsResolverIP)
 		},
 	}
-	if pathType == Upload && strings.Contains(addr, RelayAddressToReplace) {
-		addr = RelayAddress
+}()
+
+func plainTCPDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Resolver: dnsResolver,
+	}
+	return dialHost(ctx, dialer, network, addr)
+}
+
+// wsALPN is what the websocket dialer advertises, the upgrade only works over HTTP/1.1
+var wsALPN = []string{"http/1.1"}
+
+// FrontingOptions decouples where the client connects to from the names it
+// presents, so tunnels can be fronted through a CDN
+type FrontingOptions struct {
+	// ConnectAddr is the TCP address to connect to, empty uses the endpoint's host
+	ConnectAddr string
+	// Relays are TCP addresses forwarding to the server, they're rotated by a
+	// RelayPool and override ConnectAddr
+	Relays []string
+	// SNI is the TLS server name, empty uses the endpoint's host unless OmitSNI is set
+	SNI     string
+	OmitSNI bool
+	// Host is the HTTP Host header of the upgrade request, empty uses the endpoint's host
+	Host      string
+	UserAgent string
+	// Headers are extra "Name: value" headers of the upgrade request
+	Headers []string
+	// Randomize appends a random path segment ("path") or query parameter
+	// ("query") to the endpoint of every connection, empty keeps it as is
+	Randomize string
+}
+
+// queryKeys are the names random query parameters are picked from
+var queryKeys = []string{"v", "t", "id", "ts", "cb", "session", "token", "_"}
+
+// DialSettings holds the endpoint, fronting, TLS and auth settings the
+// dialers of every transport share, along with how they connect over TCP and TLS
+type DialSettings struct {
+	endpoint    string
+	fronting    FrontingOptions
+	header      http.Header
+	tlsConfig   *tls.Config
+	fingerprint *Fingerprint
+	// auth signs the upgrade requests when it isn't nil
+	auth *PSKAuth
+	// relays picks the connect address of every dial when it isn't nil
+	relays *RelayPool
+}
+
+func NewDialSettings(endpoint string, fronting FrontingOptions, tlsConfig *tls.Config, fingerprint *Fingerprint, auth *PSKAuth) (*DialSettings, error) {
+	header := http.Header{}
+	for _, h := range fronting.Headers {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid header %q, it should look like \"Name: value\"", h)
+		}
+		header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if fronting.UserAgent != "" {
+		header.Set("User-Agent", fronting.UserAgent)
+	}
+	if fronting.Host != "" {
+		// gorilla sends the Host header as the Host of the request
+		header.Set("Host", fronting.Host)
+	}
+
+	return &DialSettings{
+		endpoint:    endpoint,
+		fronting:    fronting,
+		header:      header,
+		tlsConfig:   tlsConfig,
+		fingerprint: fingerprint,
+		auth:        auth,
+	}, nil
+}
+
+// connectAddr returns where to connect to instead of addr, the port of addr
+// is kept if the connect address doesn't have one
+func (d *DialSettings) connectAddr(addr string) string {
+	if d.fronting.ConnectAddr == "" {
+		return addr
+	}
+	if _, _, err := net.SplitHostPort(d.fronting.ConnectAddr); err == nil {
+		return d.fronting.ConnectAddr
 	}
-	return dialer.DialContext(ctx, network, addr)
+	_, port, _ := net.SplitHostPort(addr)
+	return net.JoinHostPort(d.fronting.ConnectAddr, port)
 }
 
-func wsDialer(address string, pathType PathType) (*websocket.Conn, error) {
+// dialTCP connects to addr, or to the next relay when the dialer has a relay pool
+func (d *DialSettings) dialTCP(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.relays == nil {
+		return plainTCPDial(ctx, network, d.connectAddr(addr))
+	}
+	relay := d.relays.Pick()
+	conn, err := plainTCPDial(ctx, network, relay)
+	d.relays.Report(relay, err)
+	return conn, err
+}
+
+// WSDialer opens websocket connections to the server
+type WSDialer struct {
+	*DialSettings
+}
+
+func NewWSDialer(s *DialSettings) *WSDialer {
+	return &WSDialer{s}
+}
+
+func (d *WSDialer) Dial() (*websocket.Conn, error) {
 	dialer := websocket.Dialer{
 		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return plainTCPDial(ctx, network, addr, pathType)
+			return d.dialTCP(ctx, network, addr)
 		},
 
 		NetDialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			plainConn, err := plainTCPDial(ctx, network, addr, pathType)
-			if err != nil {
-				return nil, err
-			}
-			config := tls.Config{
-				ServerName:         strings.Split(addr, ":")[0],
-				InsecureSkipVerify: true,
-			}
-			utlsConn := tls.UClient(plainConn, &config, tls.HelloAndroid_11_OkHttp)
-			err = utlsConn.Handshake()
-			if err != nil {
-				_ = plainConn.Close()
-				return nil, err
-			}
-			return utlsConn, nil
+			return d.dialTLS(ctx, network, addr, wsALPN)
 		},
 	}
 
-	conn, _, err := dialer.Dial(address, nil)
+	header, err := d.requestHeader()
+	if err != nil {
+		return nil, err
+	}
+	conn, _, err := dialer.Dial(d.url(), header)
 	return conn, err
 }
 
-func wsClient(socksReq *SocksReq, socksStream *Request, endpoint string, pathType PathType) {
-	// connect to remote server via ws
-	wsConn, err := wsDialer(endpoint, pathType)
+// wsTransport opens every tunnel as a websocket, ws:// and wss:// endpoints select it
+type wsTransport struct {
+	*WSDialer
+}
+
+func (t *wsTransport) Dial(pathType PathType) (net.Conn, error) {
+	wsConn, err := t.WSDialer.Dial()
 	if err != nil {
-		if err := socks5.SendReply(socksStream.writer, statute.RepServerFailure, nil); err != nil {
-			socksStream.closeSignal <- err
-			return
+		return nil, err
+	}
+	return wsconnadapter.New(wsConn), nil
+}
+
+// dialTLS connects to addr and completes a TLS handshake that advertises alpn,
+// the connect address, server name and fingerprint follow the dialer's settings
+func (d *DialSettings) dialTLS(ctx context.Context, network, addr string, alpn []string) (*tls.UConn, error) {
+	plainConn, err := d.dialTCP(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	utlsConn, err := d.fingerprint.Client(plainConn, d.clientTLSConfig(host), alpn)
+	if err != nil {
+		_ = plainConn.Close()
+		return nil, err
+	}
+	err = utlsConn.HandshakeContext(ctx)
+	if err != nil {
+		_ = plainConn.Close()
+		return nil, err
+	}
+	return utlsConn, nil
+}
+
+// clientTLSConfig returns the TLS config of a connection to host, with the
+// server name the fronting settings ask for
+func (d *DialSettings) clientTLSConfig(host string) *tls.Config {
+	config := d.tlsConfig.Clone()
+	switch {
+	case d.fronting.OmitSNI:
+		// the certificate is still verified against the endpoint's host
+		verifyHostname(config, host)
+	case d.fronting.SNI != "":
+		config.ServerName = d.fronting.SNI
+	default:
+		config.ServerName = host
+	}
+	return config
+}
+
+// requestHeader returns the headers of a tunnel request, including a fresh
+// upgrade token when tunnels are authenticated
+func (d *DialSettings) requestHeader() (http.Header, error) {
+	header := d.header
+	if d.auth != nil {
+		// the server hands upgrades without a valid token to its fallback
+		token, err := d.auth.upgradeToken()
+		if err != nil {
+			return nil, err
 		}
-		socksStream.closeSignal <- err
-		fmt.Printf("Can not connect: %v\n", err)
-		return
+		cookie := (&http.Cookie{Name: upgradeCookie, Value: token}).String()
+		if c := header.Get("Cookie"); c != "" {
+			cookie = c + "; " + cookie
+		}
+		header = header.Clone()
+		header.Set("Cookie", cookie)
 	}
+	return header, nil
+}
 
-	fmt.Printf("%s connected\n", socksReq.Id)
+// url returns the endpoint to upgrade at, randomized if it's enabled. the
+// server accepts every path below its tunnel path
+func (d *DialSettings) url() string {
+	if d.fronting.Randomize == "" {
+		return d.endpoint
+	}
+	u, err := url.Parse(d.endpoint)
+	if err != nil {
+		return d.endpoint
+	}
+	switch d.fronting.Randomize {
+	case "path":
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + randomToken(4+mrand.Intn(12))
+	case "query":
+		q := u.Query()
+		q.Set(queryKeys[mrand.Intn(len(queryKeys))], randomToken(6+mrand.Intn(10)))
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// randomToken returns n random lowercase alphanumeric characters
+func randomToken(n int) string {
+	const alphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = alphabet[mrand.Intn(len(alphabet))]
+	}
+	return string(b)
+}
+
+// pathSession ties the paths of a socks connection together: the first path
+// to end tears the others down, and only its result is delivered to the socks
+// handler. the socks client gets a single reply
+type pathSession struct {
+	stream *Request
+
+	mutex   sync.Mutex
+	conns   []net.Conn
+	replied bool
+	done    bool
+}
+
+func newPathSession(stream *Request) *pathSession {
+	return &pathSession{stream: stream}
+}
+
+// add registers the tunnel of a path, it returns false if the session has
+// ended meanwhile and the tunnel has been closed
+func (s *pathSession) add(conn net.Conn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.done {
+		conn.Close()
+		return false
+	}
+	s.conns = append(s.conns, conn)
+	return true
+}
+
+// reply sends the socks reply, unless a path has replied already
+func (s *pathSession) reply(rep uint8) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.replied || s.done {
+		return nil
+	}
+	s.replied = true
+	return socks5.SendReply(s.stream.writer, rep, nil)
+}
 
-	conn := wsconnadapter.New(wsConn)
+// finish closes the tunnels of every path and delivers err to the socks
+// handler, only the first call has an effect
+func (s *pathSession) finish(err error) {
+	s.mutex.Lock()
+	if s.done {
+		s.mutex.Unlock()
+		return
+	}
+	s.done = true
+	conns := s.conns
+	s.mutex.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	s.stream.closeSignal <- err
+}
 
-	pathReq := PathReq{
-		socksReq.Id,
-		socksReq.Dest,
-		socksReq.Net,
-		pathType,
+// fail ends the session because of a failed path, the socks client learns
+// about it if no reply has been sent yet
+func (s *pathSession) fail(reply bool, rep uint8, err error) {
+	if reply {
+		if replyErr := s.reply(rep); replyErr != nil {
+			err = replyErr
+		}
 	}
+	s.finish(err)
+}
+
+func (c *Client) wsClient(u *upstream, socksReq *SocksReq, sess *pathSession, pathType PathType) {
+	socksStream := sess.stream
+	// unless replies are optimistic, the path that downloads is the one answering
+	// the socks client, though any path may report a failure
+	reply := !c.cfg.Optimistic
 
-	var sendBuffer bytes.Buffer        // Stand-in for a network connection
-	enc := gob.NewEncoder(&sendBuffer) // Will write to network.
-	// Encode (send) the value.
-	err = enc.Encode(&pathReq)
+	conn, err := c.openPath(u, &PathReq{
+		Id:    socksReq.Id,
+		Dest:  socksReq.Dest,
+		Net:   socksReq.Net,
+		PType: pathType,
+	})
 	if err != nil {
-		socksStream.closeSignal <- err
-		fmt.Println("encode error:", err)
+		sess.fail(reply, failureReply(err), err)
+		return
+	}
+	if !sess.add(conn) {
+		// the other path has ended already
 		return
 	}
 
-	bs := make([]byte, 2)
-	binary.BigEndian.PutUint16(bs, uint16(len(sendBuffer.Bytes())))
+	if socksReq.Net == UDP {
+		enableDatagrams(conn)
+	}
 
-	// writing request block size(2 bytes)
-	conn.Write(append(bs, sendBuffer.Bytes()...))
+	if reply && pathType != Upload {
+		// it informs the socks client that connection to remote host was successfully established
+		if err := sess.reply(statute.RepSuccess); err != nil {
+			sess.finish(err)
+			return
+		}
+	}
 
 	errCh := make(chan error, 2)
 
@@ -132,14 +392,237 @@ func wsClient(socksReq *SocksReq, socksStream *Request, endpoint string, pathTyp
 		fmt.Println("transport error:", err)
 	}
 
-	conn.Close()
-	socksStream.closeSignal <- nil
+	sess.finish(nil)
+}
+
+// openPath dials a two way tunnel and completes its handshake, failed
+// attempts are retried with a backoff on the servers that haven't been tried yet
+func (c *Client) openPath(u *upstream, pathReq *PathReq) (net.Conn, error) {
+	deadline := c.retryDeadline()
+	tried := []*upstream{u}
+
+	for attempt := 0; ; attempt++ {
+		conn, err := c.handshake(u, pathReq, deadline)
+		if err == nil {
+			return conn, nil
+		}
+		if !c.retryWait(attempt, err, deadline) {
+			return nil, err
+		}
+		u = c.balancer.Pick(tried...)
+		tried = append(tried, u)
+		fmt.Printf("%s retrying (%d/%d) via %s\n", pathReq.Id, attempt+1, c.cfg.Retry.Retries, u.endpoint)
+	}
+}
+
+// retryDeadline returns when the attempts of a connection have to give up,
+// it's zero without a deadline
+func (c *Client) retryDeadline() time.Time {
+	if c.cfg.Retry.Deadline <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(c.cfg.Retry.Deadline)
+}
+
+// retryWait waits before the attempt after attempt, it returns false when
+// err can't be retried or there's no retry left
+func (c *Client) retryWait(attempt int, err error, deadline time.Time) bool {
+	retry := c.cfg.Retry
+	if attempt >= retry.Retries || !isRetryable(err) {
+		return false
+	}
+	wait := retry.backoff(attempt)
+	if !deadline.IsZero() && time.Now().Add(wait).After(deadline) {
+		return false
+	}
+	time.Sleep(wait)
+	return true
+}
+
+// handshake dials a tunnel at u and sends the request of the path
+func (c *Client) handshake(u *upstream, pathReq *PathReq, deadline time.Time) (net.Conn, error) {
+	// connect to remote server via ws
+	conn, err := u.dial(pathReq.PType)
+	if err != nil {
+		fmt.Printf("Can not connect: %v\n", err)
+		return nil, err
+	}
+
+	fmt.Printf("%s connected\n", pathReq.Id)
+
+	if err := c.exchange(conn, pathReq, deadline); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// exchange sends the request of a path over conn and reads the reply, which
+// must arrive within attemptTimeout and before deadline unless it's zero.
+// conn is closed if it fails
+func (c *Client) exchange(conn net.Conn, pathReq *PathReq, deadline time.Time) error {
+	attemptDeadline := time.Now().Add(attemptTimeout)
+	if !deadline.IsZero() && deadline.Before(attemptDeadline) {
+		attemptDeadline = deadline
+	}
+	_ = conn.SetDeadline(attemptDeadline)
+	err := writePathReq(conn, pathReq, c.auth)
+	if err == nil {
+		err = readHandshakeReply(conn)
+	}
+	if err != nil {
+		conn.Close()
+		fmt.Println("handshake error:", err)
+		return err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return nil
+}
+
+// openSplit dials every path of a split connection at u and completes their
+// handshakes, once one of them fails the others are closed rather than left
+// waiting for the server to pair them
+func (c *Client) openSplit(u *upstream, paths []*PathReq, deadline time.Time) ([]net.Conn, error) {
+	conns := make([]net.Conn, len(paths))
+	var mutex sync.Mutex
+	var failure error
+	fail := func(err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if failure != nil {
+			return
+		}
+		failure = err
+		for _, conn := range conns {
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i, pathReq := range paths {
+		wg.Add(1)
+		go func(i int, pathReq *PathReq) {
+			defer wg.Done()
+			conn, err := u.dial(pathReq.PType)
+			if err != nil {
+				fmt.Printf("Can not connect: %v\n", err)
+				fail(err)
+				return
+			}
+			mutex.Lock()
+			aborted := failure != nil
+			conns[i] = conn
+			mutex.Unlock()
+			if aborted {
+				conn.Close()
+				return
+			}
+
+			fmt.Printf("%s connected\n", pathReq.Id)
+			if err := c.exchange(conn, pathReq, deadline); err != nil {
+				fail(err)
+			}
+		}(i, pathReq)
+	}
+	wg.Wait()
+
+	if failure != nil {
+		return nil, failure
+	}
+	return conns, nil
 }
 
-func relayClient(socksReq *SocksReq, socksStream *Request, endpoint string) {
-	// connect to remote server via ws for upload
-	go wsClient(socksReq, socksStream, endpoint, Upload)
+// failureReply maps the error of a failed path to a socks reply
+func failureReply(err error) uint8 {
+	var hsErr *HandshakeError
+	if errors.As(err, &hsErr) {
+		return socksReply(hsErr.Status)
+	}
+	return statute.RepServerFailure
+}
+
+// relayClient tunnels a connection over split paths, every direction may be
+// striped over several of them. all of them must reach the same server, it
+// pairs them by the connection id and replies once they're all there
+func (c *Client) relayClient(u *upstream, socksReq *SocksReq, socksStream *Request) {
+	sess := newPathSession(socksStream)
+	reply := !c.cfg.Optimistic
+
+	stripes := map[PathType]int{Upload: 1, Download: 1}
+	if socksReq.Net == TCP {
+		// datagrams aren't striped, the frames would merge them
+		stripes[Upload] = max(c.cfg.UploadStripes, 1)
+		stripes[Download] = max(c.cfg.DownloadStripes, 1)
+	}
+	var paths []*PathReq
+	for _, pathType := range []PathType{Upload, Download} {
+		for i := 0; i < stripes[pathType]; i++ {
+			paths = append(paths, &PathReq{
+				Id:      socksReq.Id,
+				Dest:    socksReq.Dest,
+				Net:     socksReq.Net,
+				PType:   pathType,
+				Stripe:  i,
+				Stripes: stripes[pathType],
+			})
+		}
+	}
 
-	// connect to remote server via ws for download
-	wsClient(socksReq, socksStream, endpoint, Download)
+	// a failed attempt is retried as a whole, the server may still hold
+	// paths of it, so a fresh id keeps the new ones apart
+	deadline := c.retryDeadline()
+	var conns []net.Conn
+	for attempt := 0; ; attempt++ {
+		var err error
+		if conns, err = c.openSplit(u, paths, deadline); err == nil {
+			break
+		}
+		if !c.retryWait(attempt, err, deadline) {
+			sess.fail(reply, failureReply(err), err)
+			return
+		}
+		id := NewUUID()
+		for _, pathReq := range paths {
+			pathReq.Id = id
+		}
+		fmt.Printf("%s retrying (%d/%d) as %s\n", socksReq.Id, attempt+1, c.cfg.Retry.Retries, id)
+	}
+
+	var uploads []io.Writer
+	var downloads []io.Reader
+	for i, conn := range conns {
+		if !sess.add(conn) {
+			for _, conn := range conns[i+1:] {
+				conn.Close()
+			}
+			return
+		}
+		if socksReq.Net == UDP {
+			enableDatagrams(conn)
+		}
+		if paths[i].PType == Upload {
+			uploads = append(uploads, conn)
+		} else {
+			downloads = append(downloads, conn)
+		}
+	}
+
+	if reply {
+		// it informs the socks client that connection to remote host was successfully established
+		if err := sess.reply(statute.RepSuccess); err != nil {
+			sess.finish(err)
+			return
+		}
+	}
+
+	errCh := make(chan error, 2)
+	go func() { errCh <- stripe.Send(uploads, socksStream.reader) }()
+	go func() { errCh <- stripe.Receive(socksStream.writer, downloads) }()
+
+	err := <-errCh
+	if err != nil && !strings.Contains(err.Error(), "websocket: close 1006") {
+		fmt.Println("transport error:", err)
+	}
+	sess.finish(nil)
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+)
+
+// Transport opens tunnel streams to the server. every transport carries the
+// same handshake, so the scheduler and the handlers don't care which one it is
+type Transport interface {
+	// Dial opens a tunnel stream for pathType
+	Dial(pathType PathType) (net.Conn, error)
+}
+
+// TransportFunc adapts a function to a Transport
+type TransportFunc func(pathType PathType) (net.Conn, error)
+
+func (f TransportFunc) Dial(pathType PathType) (net.Conn, error) {
+	return f(pathType)
+}
+
+// TunnelWrapper adds a layer to the tunnels of a transport whatever the
+// transport is, like the inner encryption does
+type TunnelWrapper func(conn net.Conn) (net.Conn, error)
+
+// wrapTransport returns a transport whose tunnels go through the wrappers in
+// order, a tunnel is closed when one of them fails
+func wrapTransport(t Transport, wrappers ...TunnelWrapper) Transport {
+	if len(wrappers) == 0 {
+		return t
+	}
+	return TransportFunc(func(pathType PathType) (net.Conn, error) {
+		conn, err := t.Dial(pathType)
+		if err != nil {
+			return nil, err
+		}
+		for _, wrap := range wrappers {
+			wrapped, err := wrap(conn)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			conn = wrapped
+		}
+		return conn, nil
+	})
+}
+
+// TransportFactory builds a client transport from the endpoint, fronting,
+// TLS and auth settings
+type TransportFactory func(s *DialSettings) (Transport, error)
+
+// transportFactories maps endpoint schemes to the transports they select
+var transportFactories = make(map[string]TransportFactory)
+
+// RegisterTransport makes a transport available to endpoints with one of the
+// schemes, it's meant to be called from init functions
+func RegisterTransport(factory TransportFactory, schemes ...string) {
+	for _, scheme := range schemes {
+		if _, dup := transportFactories[scheme]; dup {
+			panic("transport registered twice for scheme " + scheme)
+		}
+		transportFactories[scheme] = factory
+	}
+}
+
+func init() {
+	RegisterTransport(func(s *DialSettings) (Transport, error) {
+		return &wsTransport{NewWSDialer(s)}, nil
+	}, "ws", "wss")
+	RegisterTransport(func(s *DialSettings) (Transport, error) {
+		return NewH2Dialer(s), nil
+	}, "h2", "h2s")
+	RegisterTransport(func(s *DialSettings) (Transport, error) {
+		return NewPollDialer(s), nil
+	}, "poll", "polls")
+	RegisterTransport(func(s *DialSettings) (Transport, error) {
+		return NewQUICDialer(s)
+	}, "quic")
+	RegisterTransport(func(s *DialSettings) (Transport, error) {
+		return NewTCPDialer(s)
+	}, "tcp", "tcps")
+}
+
+// newTransport builds the transport the scheme of the endpoint selects
+func newTransport(s *DialSettings) (Transport, error) {
+	u, err := url.Parse(s.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	factory, ok := transportFactories[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported server scheme %q", u.Scheme)
+	}
+	return factory(s)
+}
+
+// TunnelHandler serves a single tunnel stream, it returns once the tunnel is closed
+type TunnelHandler func(conn net.Conn)
+
+// ServerTransport accepts tunnel streams on the server and hands each of them
+// to a handler
+type ServerTransport interface {
+	// Serve accepts tunnel streams until it fails or the transport is closed
+	Serve(handle TunnelHandler) error
+	Close() error
+}
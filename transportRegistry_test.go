@@ -0,0 +1,69 @@
+package main
+
+import (
+	"egg/aead"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestWrapTransport(t *testing.T) {
+	const secret = "secret"
+	// the fake transport hands the server side of every tunnel to the test
+	servers := make(chan net.Conn, 1)
+	fake := TransportFunc(func(pathType PathType) (net.Conn, error) {
+		if pathType != TwoWay {
+			return nil, errors.New("unexpected path type")
+		}
+		client, server := net.Pipe()
+		servers <- server
+		return client, nil
+	})
+	if wrapTransport(fake) == nil {
+		t.Fatal("no transport without wrappers")
+	}
+
+	encrypt, err := encryptTunnels("chacha20-poly1305", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan []byte, 1)
+	go func() {
+		conn, err := aead.Server(<-servers, []byte(secret))
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		b := make([]byte, 5)
+		io.ReadFull(conn, b)
+		accepted <- b
+	}()
+	conn, err := wrapTransport(fake, encrypt).Dial(TwoWay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if b := <-accepted; string(b) != "hello" {
+		t.Fatalf("the server received %q", b)
+	}
+
+	// a failing wrapper closes the tunnel
+	errWrap := errors.New("wrapper failed")
+	_, err = wrapTransport(fake, func(conn net.Conn) (net.Conn, error) {
+		return nil, errWrap
+	}).Dial(TwoWay)
+	if err != errWrap {
+		t.Fatalf("got %v instead of the wrapper's error", err)
+	}
+	if _, err := (<-servers).Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Fatalf("the tunnel is still open, the write returned %v", err)
+	}
+
+	if _, err := encryptTunnels("chacha20-poly1305", ""); err == nil {
+		t.Fatal("encryption without a pre-shared key was accepted")
+	}
+}